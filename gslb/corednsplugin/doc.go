@@ -8,4 +8,8 @@
 //     configuration file and configure `gslbcore.Config` accordingly.
 //   - `handler.go` provides the CoreDNS plugin implementation. It focuses on
 //     how to handle DNS requests and generate corresponding responses.
+//   - `reload.go` runs the `gslbcore.Core` of each zone across reloads of the
+//     configuration.
+//   - `metrics.go` exports the measurements and answers to the prometheus
+//     plugin.
 package corednsplugin
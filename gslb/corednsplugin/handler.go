@@ -35,10 +35,6 @@ func NewGslb(next plugin.Handler, core *gslbcore.GslbCore, zone string, nsA net.
 	}
 }
 
-func (p *Gslb) Run(ctx context.Context) error {
-	return p.core.Run(ctx)
-}
-
 var _ = plugin.Handler(&Gslb{})
 
 const Ttl = 120
@@ -69,53 +65,79 @@ func (p *Gslb) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 	subdomain = subdomain[:len(subdomain)-1]
 	subdomain = strings.ToLower(subdomain)
 
-	srcIP := net.ParseIP(state.IP())
-	if opt := r.IsEdns0(); opt != nil {
-		for _, edns0 := range opt.Option {
-			if edns0.Option() == dns.EDNS0SUBNET {
-				srcIP = edns0.(*dns.EDNS0_SUBNET).Address
-				break
-			}
-		}
+	q := gslbcore.DNSQuery{Service: subdomain}
+	if addr, err := netip.ParseAddr(state.IP()); err == nil {
+		q.Resolver = addr.Unmap()
 	}
-
-	records, err := p.A(ctx, state.QName(), subdomain, srcIP)
-	if err != nil {
-		log.Errorf("err: %v", err)
-		return dns.RcodeServerFailure, err
+	ecs := clientSubnet(r)
+	if ecs != nil && ecs.SourceNetmask > 0 {
+		if addr, ok := netip.AddrFromSlice(ecs.Address); ok {
+			addr = addr.Unmap()
+			q.ClientSubnet, _ = addr.Prefix(min(int(ecs.SourceNetmask), addr.BitLen()))
+		}
 	}
 
-	if len(records) == 0 {
+	if _, ok := p.core.Service(subdomain); !ok {
 		m := new(dns.Msg)
 		m.SetRcode(r, dns.RcodeNameError)
 		m.Ns = []dns.RR{p.soaRecord()}
-		if err := w.WriteMsg(m); err != nil {
-			log.Debugf("WriteMsg err=%v", err)
-		}
+		p.writeMsg(state, m, ecs, false)
 		return dns.RcodeNameError, nil
 	}
 
-	if state.QType() != dns.TypeA {
-		// Name exists but we have no records of this type: NODATA.
-		m := new(dns.Msg)
-		m.SetReply(r)
-		m.Authoritative = true
-		m.Ns = []dns.RR{p.soaRecord()}
-		if err := w.WriteMsg(m); err != nil {
-			log.Debugf("WriteMsg err=%v", err)
-		}
-		return dns.RcodeSuccess, nil
+	records, err := p.Answer(ctx, state.QName(), state.QType(), q)
+	if err != nil {
+		log.Errorf("err: %v", err)
+		return dns.RcodeServerFailure, err
 	}
 
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Authoritative = true
+	if len(records) == 0 {
+		// Name exists but we have no records of this type: NODATA.
+		m.Ns = []dns.RR{p.soaRecord()}
+	}
 	m.Answer = append(m.Answer, records...)
+	p.writeMsg(state, m, ecs, true)
+	return dns.RcodeSuccess, nil
+}
 
-	if err := w.WriteMsg(m); err != nil {
+// clientSubnet returns the EDNS0 client subnet option of the request, or nil.
+// Options of families other than IPv4 and IPv6 are ignored.
+func clientSubnet(r *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok && (ecs.Family == 1 || ecs.Family == 2) {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// writeMsg writes m with the EDNS0 of the request. The client subnet of the
+// request, if any, is echoed back, scoped to the whole subnet if the answer
+// depends on it.
+func (p *Gslb) writeMsg(state request.Request, m *dns.Msg, ecs *dns.EDNS0_SUBNET, scoped bool) {
+	if ecs != nil {
+		echo := *ecs
+		echo.SourceScope = 0
+		if scoped {
+			echo.SourceScope = ecs.SourceNetmask
+		}
+		m.Extra = append(m.Extra, &dns.OPT{
+			Hdr:    dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT},
+			Option: []dns.EDNS0{&echo},
+		})
+	}
+	state.SizeAndDo(m)
+
+	if err := state.W.WriteMsg(m); err != nil {
 		log.Debugf("WriteMsg err=%v", err)
 	}
-	return dns.RcodeSuccess, nil
 }
 
 // Name implements the Handler interface.
@@ -172,27 +194,34 @@ func (p *Gslb) soaRecord() *dns.SOA {
 	}
 }
 
-func (p *Gslb) A(ctx context.Context, qname, subdomain string, srcIP net.IP) ([]dns.RR, error) {
-	records := []dns.RR{}
-
-	// FIXME: we only act on "www.[domain]" for now.
-	if "www" == subdomain {
-		srcIP, ok := netip.AddrFromSlice(srcIP)
-		if !ok {
-			return nil, fmt.Errorf("netip.AddrFromSlice(%v) failed.", srcIP)
-		}
-		srcIP = srcIP.Unmap()
+// Answer returns the A or AAAA records of the PoPs to answer q with, and
+// records the decision in the query log. Queries of other types have no
+// records.
+func (p *Gslb) Answer(ctx context.Context, qname string, qtype uint16, q gslbcore.DNSQuery) ([]dns.RR, error) {
+	svc, ok := p.core.Service(q.Service)
+	if !ok {
+		return nil, fmt.Errorf("Unknown service %q", q.Service)
+	}
 
-		ips := p.core.Query(srcIP)
+	switch qtype {
+	case dns.TypeA:
+		q.Family = gslbcore.IPv4
+	case dns.TypeAAAA:
+		q.Family = gslbcore.IPv6
+	default:
+		return nil, nil
+	}
 
-		for _, ip := range ips {
-			ip4 := ip.As4()
-			records = append(records, &dns.A{
-				Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: Ttl},
-				A:   ip4[:],
-			})
+	records := []dns.RR{}
+	for _, ip := range p.core.QueryDNS(q) {
+		answerCount.WithLabelValues(p.zone, svc.Name, p.core.PopIdFromIP(ip)).Inc()
+
+		hdr := dns.RR_Header{Name: qname, Rrtype: qtype, Class: dns.ClassINET, Ttl: svc.Ttl}
+		if q.Family == gslbcore.IPv4 {
+			records = append(records, &dns.A{Hdr: hdr, A: ip.AsSlice()})
+		} else {
+			records = append(records, &dns.AAAA{Hdr: hdr, AAAA: ip.AsSlice()})
 		}
 	}
-
 	return records, nil
 }
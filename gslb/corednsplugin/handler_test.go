@@ -0,0 +1,143 @@
+package corednsplugin_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+
+	"github.com/yzp0n/ncdn/gslb/corednsplugin"
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+	"github.com/yzp0n/ncdn/types"
+)
+
+func newTestGslb() *corednsplugin.Gslb {
+	core := gslbcore.New(&gslbcore.Config{
+		Pops: []types.PoPInfo{
+			{Id: "v4only", Ip4: netip.MustParseAddr("192.0.2.1")},
+			{Id: "dualstack", Ip4: netip.MustParseAddr("192.0.2.2"), Ip6: netip.MustParseAddr("2001:db8::2")},
+			{Id: "v6only", Ip6: netip.MustParseAddr("2001:db8::3")},
+		},
+		Regions: []types.RegionInfo{
+			{Id: "v4land", Prefixes: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}},
+			{Id: "v6land", Prefixes: []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/48")}},
+		},
+		Services: []gslbcore.Service{
+			{Name: "www"},
+			{Name: "img", PopIds: []string{"v4only"}, Ttl: 300},
+		},
+		// No PoP status is fetched, so all PoPs are answered fail-open.
+		Policy: &gslbcore.GeoPolicy{RegionPop: map[string]string{
+			"v4land": "v4only",
+			"v6land": "v6only",
+		}},
+	})
+	return corednsplugin.NewGslb(nil, core, "example.com.", net.ParseIP("192.0.2.53"))
+}
+
+func TestServeDNS(t *testing.T) {
+	g := newTestGslb()
+
+	testcases := []struct {
+		Name     string
+		QName    string
+		QType    uint16
+		RemoteIP string
+		ECS      string // client subnet, if any
+
+		Rcode     int
+		Want      []string
+		WantScope uint8
+	}{
+		{Name: "a-no-region", QName: "www.example.com.", QType: dns.TypeA, Rcode: dns.RcodeSuccess, Want: []string{"192.0.2.1"}},
+		{Name: "aaaa-no-region", QName: "www.example.com.", QType: dns.TypeAAAA, Rcode: dns.RcodeSuccess, Want: []string{"2001:db8::2"}},
+		{Name: "aaaa-v6-remote", QName: "www.example.com.", QType: dns.TypeAAAA, RemoteIP: "2001:db8:1::5", Rcode: dns.RcodeSuccess, Want: []string{"2001:db8::3"}},
+		{Name: "aaaa-v6-ecs", QName: "www.example.com.", QType: dns.TypeAAAA, ECS: "2001:db8:1::/56", Rcode: dns.RcodeSuccess, Want: []string{"2001:db8::3"}, WantScope: 56},
+		{Name: "a-v6-ecs", QName: "www.example.com.", QType: dns.TypeA, ECS: "2001:db8:1::/56", Rcode: dns.RcodeSuccess, Want: []string{"192.0.2.1"}, WantScope: 56},
+		{Name: "a-v4-ecs", QName: "www.example.com.", QType: dns.TypeA, ECS: "198.51.100.0/24", Rcode: dns.RcodeSuccess, Want: []string{"192.0.2.1"}, WantScope: 24},
+		// The geo PoP of v4land has no IPv6 address.
+		{Name: "aaaa-v4-ecs", QName: "www.example.com.", QType: dns.TypeAAAA, ECS: "198.51.100.0/24", Rcode: dns.RcodeSuccess, Want: []string{"2001:db8::2"}, WantScope: 24},
+		// A zero source prefix opts out of ECS.
+		{Name: "aaaa-ecs-opt-out", QName: "www.example.com.", QType: dns.TypeAAAA, RemoteIP: "2001:db8:1::5", ECS: "::/0", Rcode: dns.RcodeSuccess, Want: []string{"2001:db8::3"}},
+		{Name: "txt-nodata", QName: "www.example.com.", QType: dns.TypeTXT, Rcode: dns.RcodeSuccess},
+		{Name: "img-a", QName: "IMG.example.com.", QType: dns.TypeA, Rcode: dns.RcodeSuccess, Want: []string{"192.0.2.1"}},
+		// No PoP serving img has an IPv6 address.
+		{Name: "img-aaaa-nodata", QName: "img.example.com.", QType: dns.TypeAAAA, Rcode: dns.RcodeSuccess},
+		{Name: "nxdomain", QName: "foo.example.com.", QType: dns.TypeAAAA, ECS: "2001:db8:1::/56", Rcode: dns.RcodeNameError},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(tc.QName, tc.QType)
+			if tc.ECS != "" {
+				prefix := netip.MustParsePrefix(tc.ECS)
+				family := uint16(1)
+				if prefix.Addr().Is6() {
+					family = 2
+				}
+				req.SetEdns0(4096, false)
+				opt := req.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+					Code:          dns.EDNS0SUBNET,
+					Family:        family,
+					SourceNetmask: uint8(prefix.Bits()),
+					Address:       prefix.Addr().AsSlice(),
+				})
+			}
+
+			rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: tc.RemoteIP})
+			if _, err := g.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatalf("ServeDNS: %v", err)
+			}
+			m := rec.Msg
+
+			if m.Rcode != tc.Rcode {
+				t.Errorf("rcode: got %s, want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[tc.Rcode])
+			}
+			if len(m.Answer) == 0 && len(m.Ns) == 0 {
+				t.Errorf("negative answer without SOA")
+			}
+
+			wantTtl := uint32(gslbcore.DefaultTtl)
+			if strings.EqualFold(tc.QName, "img.example.com.") {
+				wantTtl = 300
+			}
+			var got []string
+			for _, rr := range m.Answer {
+				if rr.Header().Ttl != wantTtl {
+					t.Errorf("ttl: got %d, want %d", rr.Header().Ttl, wantTtl)
+				}
+				if rr.Header().Rrtype != tc.QType {
+					t.Errorf("answer of type %s to %s query", dns.TypeToString[rr.Header().Rrtype], dns.TypeToString[tc.QType])
+				}
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = append(got, rr.A.String())
+				case *dns.AAAA:
+					got = append(got, rr.AAAA.String())
+				}
+			}
+			if !slices.Equal(got, tc.Want) {
+				t.Errorf("answers: got %v, want %v", got, tc.Want)
+			}
+
+			if tc.ECS == "" {
+				return
+			}
+			opt := m.IsEdns0()
+			if opt == nil || len(opt.Option) != 1 {
+				t.Fatalf("client subnet is not echoed: %v", opt)
+			}
+			ecs := opt.Option[0].(*dns.EDNS0_SUBNET)
+			if ecs.SourceScope != tc.WantScope {
+				t.Errorf("scope: got %d, want %d", ecs.SourceScope, tc.WantScope)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package corednsplugin
+
+import (
+	"github.com/coredns/coredns/plugin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+)
+
+var (
+	// probeCount is the count of PoP status fetches, latency probes and
+	// health checks by their result.
+	probeCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "probes_total",
+		Help:      "Counter of PoP status fetches, latency probes and health checks.",
+	}, []string{"zone", "kind", "region", "service", "pop", "result"})
+
+	// probeDuration is the time the probes took, whether they succeeded or not.
+	probeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "probe_duration_seconds",
+		Buckets:   plugin.TimeBuckets,
+		Help:      "Histogram of the time PoP status fetches, latency probes and health checks took.",
+	}, []string{"zone", "kind", "region", "service", "pop"})
+
+	// answerCount is the count of PoPs answered to DNS queries. A response
+	// of several PoPs counts for each of them.
+	answerCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: PluginName,
+		Name:      "answers_total",
+		Help:      "Counter of PoPs answered to DNS queries.",
+	}, []string{"zone", "service", "pop"})
+)
+
+// observeProbe returns a gslbcore.ObserveProbeFunc recording the probes of
+// the zone.
+func observeProbe(zone string) gslbcore.ObserveProbeFunc {
+	return func(res gslbcore.ProbeResult) {
+		result := "success"
+		if res.Err != nil {
+			result = "failure"
+		}
+		probeCount.WithLabelValues(zone, string(res.Kind), res.RegionId, res.Service, res.PopId, result).Inc()
+		probeDuration.WithLabelValues(zone, string(res.Kind), res.RegionId, res.Service, res.PopId).Observe(res.Took.Seconds())
+	}
+}
+
+var (
+	popHealthyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(plugin.Namespace, PluginName, "pop_healthy"),
+		"Whether the PoP is answerable: 1 if healthy, 0 if erroring, drained or disabled.",
+		[]string{"zone", "pop"}, nil)
+	popLoadDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(plugin.Namespace, PluginName, "pop_load"),
+		"The load the PoP reported in its last status.",
+		[]string{"zone", "pop"}, nil)
+	popUtilizationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(plugin.Namespace, PluginName, "pop_utilization"),
+		"The load of the PoP relative to its capacity, or 0 if the capacity is not configured.",
+		[]string{"zone", "pop"}, nil)
+	latencyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(plugin.Namespace, PluginName, "latency_seconds"),
+		"The estimated latency from the region to the PoP in seconds, if known.",
+		[]string{"zone", "region", "pop"}, nil)
+)
+
+// statusCollector exports the measurements of the running GslbCores. They
+// are read at scrape time, so that a reload replaces them without leaving
+// the PoPs and regions of the previous configuration behind.
+type statusCollector struct{}
+
+func (statusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- popHealthyDesc
+	ch <- popLoadDesc
+	ch <- popUtilizationDesc
+	ch <- latencyDesc
+}
+
+func (statusCollector) Collect(ch chan<- prometheus.Metric) {
+	for zone, core := range runningCores() {
+		st := core.Status()
+		for _, pop := range st.Pops {
+			healthy := 0.0
+			if pop.Healthy {
+				healthy = 1
+			}
+			ch <- prometheus.MustNewConstMetric(popHealthyDesc, prometheus.GaugeValue, healthy, zone, pop.PopId)
+			ch <- prometheus.MustNewConstMetric(popLoadDesc, prometheus.GaugeValue, pop.Load, zone, pop.PopId)
+			ch <- prometheus.MustNewConstMetric(popUtilizationDesc, prometheus.GaugeValue, pop.Utilization, zone, pop.PopId)
+		}
+		for regionId, m := range st.Latency {
+			for popId, lat := range m {
+				ch <- prometheus.MustNewConstMetric(latencyDesc, prometheus.GaugeValue, lat/1000, zone, regionId, popId)
+			}
+		}
+	}
+}
+
+func init() {
+	// The prometheus plugin serves the default registry.
+	prometheus.MustRegister(statusCollector{})
+}
@@ -0,0 +1,56 @@
+package corednsplugin_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gatherCounter returns the value of the counter of the labels in the
+// default registry, which the prometheus plugin serves.
+func gatherCounter(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	METRICS:
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if want, ok := labels[lp.GetName()]; ok && want != lp.GetValue() {
+					continue METRICS
+				}
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestAnswerMetrics(t *testing.T) {
+	g := newTestGslb()
+	labels := map[string]string{"zone": "example.com.", "service": "img", "pop": "v4only"}
+	before := gatherCounter(t, "coredns_ncdn_gslb_answers_total", labels)
+
+	for range 2 {
+		req := new(dns.Msg)
+		req.SetQuestion("img.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := g.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("ServeDNS: %v", err)
+		}
+	}
+
+	if got := gatherCounter(t, "coredns_ncdn_gslb_answers_total", labels) - before; got != 2 {
+		t.Errorf("answers_total: got %v more, want 2", got)
+	}
+}
@@ -0,0 +1,98 @@
+package corednsplugin
+
+import (
+	"context"
+	"sync"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+)
+
+// runner runs a GslbCore in the background until stopped.
+type runner struct {
+	core *gslbcore.GslbCore
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (r *runner) start() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	r.cancel, r.done = cancel, done
+	go func() {
+		defer close(done)
+		if err := r.core.Run(ctx); err != nil {
+			clog.Fatalf("Failed to run %s: %v", PluginName, err)
+		}
+	}()
+	return nil
+}
+
+// stop stops the GslbCore, and waits until it has.
+func (r *runner) stop() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel == nil {
+		return nil
+	}
+
+	r.cancel()
+	<-r.done
+	r.cancel, r.done = nil, nil
+	return nil
+}
+
+// The GslbCores last started for each zone. On reload, CoreDNS stops the
+// running ones before setting up their successors, which carry over their
+// measurements.
+var (
+	runnersMu sync.Mutex
+	runners   = make(map[string]*runner)
+)
+
+// lastCore returns the GslbCore last started for the zone, or nil.
+func lastCore(zone string) *gslbcore.GslbCore {
+	runnersMu.Lock()
+	defer runnersMu.Unlock()
+	if r := runners[zone]; r != nil {
+		return r.core
+	}
+	return nil
+}
+
+// setRunner records r as the one last started for the zone.
+func setRunner(zone string, r *runner) {
+	runnersMu.Lock()
+	defer runnersMu.Unlock()
+	runners[zone] = r
+}
+
+// running returns whether the GslbCore is running.
+func (r *runner) running() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cancel != nil
+}
+
+// runningCores returns the running GslbCores, keyed by their zones.
+func runningCores() map[string]*gslbcore.GslbCore {
+	runnersMu.Lock()
+	defer runnersMu.Unlock()
+
+	cores := make(map[string]*gslbcore.GslbCore)
+	for zone, r := range runners {
+		if r.running() {
+			cores[zone] = r.core
+		}
+	}
+	return cores
+}
@@ -1,10 +1,13 @@
 package corednsplugin
 
 import (
-	"context"
 	"fmt"
 	"net"
 	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
@@ -33,6 +36,10 @@ func setup(c *caddy.Controller) error {
 
 	var ccfg gslbcore.Config
 
+	// The policies are parsed once all pops and regions are known.
+	var policyArgs []string
+	var servicePolicyArgs [][]string
+
 	for c.Next() {
 		for c.NextBlock() {
 			switch c.Val() {
@@ -42,12 +49,191 @@ func setup(c *caddy.Controller) error {
 				}
 				ccfg.HTTPServer = c.Val()
 
+			case "default_pop":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				ccfg.DefaultPop = c.Val()
+
+			case "policy":
+				policyArgs = c.RemainingArgs()
+				if len(policyArgs) == 0 {
+					return c.ArgErr()
+				}
+
+			case "spillover_threshold": // shorthand for "policy spillover THRESHOLD"
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				policyArgs = []string{"spillover", c.Val()}
+
+			case "prefixes_reload":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				s := c.Val()
+				interval, err := time.ParseDuration(s)
+				if err != nil || interval <= 0 {
+					return c.Errf("Failed to parse prefixes_reload=%q", s)
+				}
+				ccfg.PrefixReloadInterval = interval
+
+			case "latency_samples", "latency_max_failures", "probe_concurrency", "answers",
+				"query_log_size", "rum_min_samples":
+				directive := c.Val()
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				s := c.Val()
+				n, err := strconv.Atoi(s)
+				if err != nil || n <= 0 {
+					return c.Errf("%s=%q must be a positive integer", directive, s)
+				}
+				switch directive {
+				case "latency_samples":
+					ccfg.LatencySamples = n
+				case "latency_max_failures":
+					ccfg.LatencyMaxFailures = n
+				case "query_log_size":
+					ccfg.QueryLogSize = n
+				case "rum_min_samples":
+					ccfg.RUMMinSamples = n
+				case "answers":
+					ccfg.Answers = n
+				default:
+					ccfg.ProbeConcurrency = n
+				}
+
+			case "latency_alpha":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				s := c.Val()
+				alpha, err := strconv.ParseFloat(s, 64)
+				if err != nil || alpha <= 0 || alpha > 1 {
+					return c.Errf("latency_alpha=%q must be a number in (0, 1]", s)
+				}
+				ccfg.LatencyAlpha = alpha
+
+			case "rum_weight":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				s := c.Val()
+				weight, err := strconv.ParseFloat(s, 64)
+				if err != nil || weight <= 0 || weight > 1 {
+					return c.Errf("rum_weight=%q must be a number in (0, 1]", s)
+				}
+				ccfg.RUMWeight = weight
+
+			case "latency_trim":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				s := c.Val()
+				trim, err := strconv.ParseFloat(s, 64)
+				if err != nil || trim < 0 || trim >= 0.5 {
+					return c.Errf("latency_trim=%q must be a number in [0, 0.5)", s)
+				}
+				ccfg.LatencyTrim = trim
+
+			case "shuffle_margin":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				s := c.Val()
+				margin, err := strconv.ParseFloat(s, 64)
+				if err != nil || margin < 0 {
+					return c.Errf("shuffle_margin=%q must be a non-negative number", s)
+				}
+				ccfg.ShuffleMargin = margin
+
+			case "switch_margin":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				s := c.Val()
+				margin, err := strconv.ParseFloat(s, 64)
+				if err != nil || margin < 0 || margin >= 1 {
+					return c.Errf("switch_margin=%q must be a number in [0, 1)", s)
+				}
+				ccfg.SwitchMargin = margin
+
+			case "switch_rounds", "flap_threshold":
+				directive := c.Val()
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				s := c.Val()
+				n, err := strconv.Atoi(s)
+				if err != nil || n <= 0 {
+					return c.Errf("%s=%q must be a positive integer", directive, s)
+				}
+				if directive == "switch_rounds" {
+					ccfg.SwitchRounds = n
+				} else {
+					ccfg.FlapThreshold = n
+				}
+
+			case "flap_window", "flap_hold_down",
+				"status_interval", "latency_interval", "status_timeout", "probe_timeout", "jitter",
+				"state_save_interval", "state_max_age", "rum_window":
+				directive := c.Val()
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				s := c.Val()
+				d, err := time.ParseDuration(s)
+				if err != nil || d <= 0 {
+					return c.Errf("Failed to parse %s=%q", directive, s)
+				}
+				switch directive {
+				case "flap_window":
+					ccfg.FlapWindow = d
+				case "flap_hold_down":
+					ccfg.FlapHoldDown = d
+				case "status_interval":
+					ccfg.StatusInterval = d
+				case "latency_interval":
+					ccfg.LatencyInterval = d
+				case "status_timeout":
+					ccfg.StatusTimeout = d
+				case "probe_timeout":
+					ccfg.ProbeTimeout = d
+				case "jitter":
+					ccfg.Jitter = d
+				case "state_save_interval":
+					ccfg.StateSaveInterval = d
+				case "state_max_age":
+					ccfg.StateMaxAge = d
+				default:
+					ccfg.RUMWindow = d
+				}
+
+			case "state_file":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				ccfg.StateFile = c.Val()
+
+			case "query_log_file":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				ccfg.QueryLogFile = c.Val()
+
 			case "prober_secret":
 				if !c.NextArg() {
 					return c.ArgErr()
 				}
 				ccfg.ProberSecret = c.Val()
 
+			case "admin_secret":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				ccfg.AdminSecret = c.Val()
+
 			case "pop":
 				if !c.NextArg() {
 					return c.ArgErr()
@@ -67,8 +253,8 @@ func setup(c *caddy.Controller) error {
 						for c.NextArg() {
 							s := c.Val()
 							ip4, err := netip.ParseAddr(s)
-							if err != nil {
-								return c.Errf("Failed to parse pop_ip4=%q: %v", s, err)
+							if err != nil || !ip4.Is4() {
+								return c.Errf("Failed to parse pop_ip4=%q as an IPv4 address", s)
 							}
 							pop.Ip4 = ip4
 						}
@@ -90,12 +276,50 @@ func setup(c *caddy.Controller) error {
 							pop.Ip4 = ip4
 						}
 
+					case "ip6":
+						for c.NextArg() {
+							s := c.Val()
+							ip6, err := netip.ParseAddr(s)
+							if err != nil || !ip6.Is6() || ip6.Is4In6() {
+								return c.Errf("Failed to parse pop_ip6=%q as an IPv6 address", s)
+							}
+							pop.Ip6 = ip6
+						}
+
+					case "ip6_lookup":
+						for c.NextArg() {
+							s := c.Val()
+
+							addr, err := net.ResolveIPAddr("ip6", s)
+							if err != nil {
+								return c.Errf("Failed to resolve pop_ip6_lookup=%q: %v", s, err)
+							}
+							ip6, ok := netip.AddrFromSlice(addr.IP)
+							if !ok {
+								return c.Errf("Failed to convert %v to netip.Addr", addr.IP)
+							}
+							fmt.Printf("Resolved pop_ip6_lookup=%q to %s\n", s, ip6)
+
+							pop.Ip6 = ip6
+						}
+
 					case "latency_endpoint_url":
 						if !c.NextArg() {
 							return c.ArgErr()
 						}
 						pop.LatencyEndpointUrl = c.Val()
 
+					case "capacity":
+						if !c.NextArg() {
+							return c.ArgErr()
+						}
+						s := c.Val()
+						capacity, err := strconv.ParseFloat(s, 64)
+						if err != nil || capacity < 0 {
+							return c.Errf("Failed to parse capacity=%q", s)
+						}
+						pop.Capacity = capacity
+
 					case "ui_popup_css":
 						if !c.NextArg() {
 							return c.ArgErr()
@@ -109,6 +333,9 @@ func setup(c *caddy.Controller) error {
 						return c.Errf("unknown pop property '%s'", c.Val())
 					}
 				}
+				if !pop.Ip4.IsValid() && !pop.Ip6.IsValid() {
+					return c.Errf("pop %q has neither ip4 nor ip6", pop.Id)
+				}
 				ccfg.Pops = append(ccfg.Pops, pop)
 
 			case "region":
@@ -136,12 +363,46 @@ func setup(c *caddy.Controller) error {
 							r.Prefixes = append(r.Prefixes, prefix)
 						}
 
+					case "prefixes_from":
+						args := c.RemainingArgs()
+						if len(args) < 2 {
+							return c.ArgErr()
+						}
+						src := types.PrefixSource{Format: args[0], Path: args[1]}
+						for _, a := range args[2:] {
+							k, v, _ := strings.Cut(a, "=")
+							switch k {
+							case "country":
+								src.Country = v
+							case "asn":
+								for _, s := range strings.Split(v, ",") {
+									asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(s), "AS"), 10, 32)
+									if err != nil {
+										return c.Errf("Failed to parse asn=%q: %v", s, err)
+									}
+									src.ASNs = append(src.ASNs, uint32(asn))
+								}
+							default:
+								return c.Errf("unknown prefixes_from option '%s'", a)
+							}
+						}
+						r.PrefixSources = append(r.PrefixSources, src)
+
 					case "prober_url":
 						if !c.NextArg() {
 							return c.ArgErr()
 						}
 						r.ProberURL = c.Val()
 
+					case "latency_phase":
+						if !c.NextArg() {
+							return c.ArgErr()
+						}
+						if _, err := gslbcore.ParseProbePhase(c.Val()); err != nil {
+							return c.Errf("Failed to parse latency_phase: %v", err)
+						}
+						r.LatencyPhase = c.Val()
+
 					case "ui_popup_css":
 						if !c.NextArg() {
 							return c.ArgErr()
@@ -157,6 +418,76 @@ func setup(c *caddy.Controller) error {
 				}
 				ccfg.Regions = append(ccfg.Regions, r)
 
+			case "service":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				svc := gslbcore.Service{Name: strings.ToLower(c.Val())}
+				var svcPolicyArgs []string
+				fmt.Printf("Service=%s\n", svc.Name)
+
+				// can't rely on `c.NextBlock()` since nesting is not supported.
+				if !c.NextArg() || c.Val() != "{" {
+					return c.Errf("Expected '{' after service name")
+				}
+
+			SERVICE_LOOP:
+				for c.Next() {
+					switch c.Val() {
+					case "pops":
+						args := c.RemainingArgs()
+						if len(args) == 0 {
+							return c.ArgErr()
+						}
+						svc.PopIds = append(svc.PopIds, args...)
+
+					case "policy":
+						svcPolicyArgs = c.RemainingArgs()
+						if len(svcPolicyArgs) == 0 {
+							return c.ArgErr()
+						}
+
+					case "answers":
+						if !c.NextArg() {
+							return c.ArgErr()
+						}
+						s := c.Val()
+						n, err := strconv.Atoi(s)
+						if err != nil || n <= 0 {
+							return c.Errf("answers=%q must be a positive integer", s)
+						}
+						svc.Answers = n
+
+					case "ttl":
+						if !c.NextArg() {
+							return c.ArgErr()
+						}
+						s := c.Val()
+						ttl, err := strconv.ParseUint(s, 10, 32)
+						if err != nil || ttl == 0 {
+							return c.Errf("ttl=%q must be a positive integer", s)
+						}
+						svc.Ttl = uint32(ttl)
+
+					case "health_check":
+						if !c.NextArg() {
+							return c.ArgErr()
+						}
+						svc.HealthCheckUrl = c.Val()
+
+					case "}":
+						break SERVICE_LOOP
+
+					default:
+						return c.Errf("unknown service property '%s'", c.Val())
+					}
+				}
+				if slices.ContainsFunc(ccfg.Services, func(s gslbcore.Service) bool { return s.Name == svc.Name }) {
+					return c.Errf("service %q is declared twice", svc.Name)
+				}
+				ccfg.Services = append(ccfg.Services, svc)
+				servicePolicyArgs = append(servicePolicyArgs, svcPolicyArgs)
+
 			case "ns_a_addr":
 				if !c.NextArg() {
 					return c.ArgErr()
@@ -176,20 +507,73 @@ func setup(c *caddy.Controller) error {
 	if nsA == nil {
 		return fmt.Errorf("ns_a_addr is required.")
 	}
+	if ccfg.DefaultPop != "" && !slices.ContainsFunc(ccfg.Pops, func(p types.PoPInfo) bool { return p.Id == ccfg.DefaultPop }) {
+		return fmt.Errorf("default_pop %q is not a known pop.", ccfg.DefaultPop)
+	}
+
+	if ccfg.QueryLogFile != "" {
+		// Fail early on an unwritable query log. See GslbCore.Run.
+		f, err := gslbcore.OpenQueryLogFile(ccfg.QueryLogFile)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
 
+	if len(policyArgs) > 0 {
+		policy, err := gslbcore.ParsePolicy(&ccfg, policyArgs[0], policyArgs[1:])
+		if err != nil {
+			return fmt.Errorf("Failed to configure policy: %v", err)
+		}
+		ccfg.Policy = policy
+	}
+
+	for i := range ccfg.Services {
+		svc := &ccfg.Services[i]
+		for _, id := range svc.PopIds {
+			if !slices.ContainsFunc(ccfg.Pops, func(p types.PoPInfo) bool { return p.Id == id }) {
+				return fmt.Errorf("pop %q of service %q is not a known pop.", id, svc.Name)
+			}
+		}
+		if args := servicePolicyArgs[i]; len(args) > 0 {
+			policy, err := gslbcore.ParsePolicy(&ccfg, args[0], args[1:])
+			if err != nil {
+				return fmt.Errorf("Failed to configure policy of service %q: %v", svc.Name, err)
+			}
+			svc.Policy = policy
+		}
+	}
+
+	zone := origins[0]
+	ccfg.ObserveProbe = observeProbe(zone)
 	core := gslbcore.New(&ccfg)
+	if prev := lastCore(zone); prev != nil {
+		core.CarryOver(prev)
+	}
+	if slices.ContainsFunc(ccfg.Regions, func(r types.RegionInfo) bool { return len(r.PrefixSources) > 0 }) {
+		// Fail early on misconfigured sources. Later reloads keep the
+		// prefixes loaded so far on errors.
+		if err := core.ReloadPrefixes(); err != nil {
+			return err
+		}
+	}
+
+	// Like the health plugin, stop measuring on reload so that the HTTP
+	// server frees its address for the successor, and resume if the reload
+	// fails.
+	r := &runner{core: core}
+	c.OnStartup(func() error {
+		setRunner(zone, r)
+		return r.start()
+	})
+	c.OnRestart(r.stop)
+	c.OnRestartFailed(r.start)
+	c.OnFinalShutdown(r.stop)
 
 	dnscfg := dnsserver.GetConfig(c)
 	dnscfg.AddPlugin(func(next plugin.Handler) plugin.Handler {
-		zone := origins[0]
 		log.Infof("Added plugin %s. Zone=%s", PluginName, zone)
-		p := NewGslb(next, core, zone, nsA)
-		go func() {
-			if err := p.Run(context.Background()); err != nil {
-				clog.Fatalf("Failed to run %s: %v", PluginName, err)
-			}
-		}()
-		return p
+		return NewGslb(next, core, zone, nsA)
 	})
 
 	return nil
@@ -12,6 +12,7 @@ import (
 	_ "github.com/coredns/coredns/plugin/metrics"
 	_ "github.com/coredns/coredns/plugin/pprof"
 	_ "github.com/coredns/coredns/plugin/ready"
+	_ "github.com/coredns/coredns/plugin/reload"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
@@ -27,6 +28,7 @@ func init() {
 	// Try to match order of
 	// https://github.com/coredns/coredns/blob/master/plugin.cfg
 	dnsserver.Directives = []string{
+		"reload",
 		"debug",
 		"log",
 		"ready",
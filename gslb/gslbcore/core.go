@@ -1,10 +1,15 @@
 package gslbcore
 
 import (
+	"cmp"
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"net/netip"
+	"os"
+	"slices"
 	"sync"
 	"time"
 
@@ -14,7 +19,7 @@ import (
 // FetchPoPStatus is a function that fetches PoP status from a PoP.
 type FetchPoPStatusFunc func(ctx context.Context, ip netip.Addr) (*types.PoPStatus, error)
 
-type MakeLatencyMeasurerFunc func(proberURL, secret string) LatencyMeasurer
+type MakeLatencyMeasurerFunc func(region types.RegionInfo, secret string) LatencyMeasurer
 
 type LatencyMeasurer interface {
 	DebugString() string
@@ -29,13 +34,137 @@ type Config struct {
 	ProberSecret string
 	HTTPServer   string
 
+	// The bearer token required by the admin API of HTTPServer, which is
+	// disabled if empty.
+	AdminSecret string
+
+	// The PoP id to answer for clients not in any region. If empty or
+	// unhealthy, the PoP with the lowest latency averaged over all regions
+	// is used.
+	DefaultPop string
+
+	// Interval to reload the prefix sources of the regions. Defaults to an
+	// hour.
+	PrefixReloadInterval time.Duration
+
+	// Number of latency samples taken per PoP in each measurement round.
+	// Defaults to 3.
+	LatencySamples int
+
+	// The samples of a round are combined by their median, or if non-zero,
+	// by their mean after discarding this fraction of them from each end.
+	LatencyTrim float64
+
+	// Weight of the latest round in the moving average of the latency.
+	// Defaults to 0.3.
+	LatencyAlpha float64
+
+	// The latency becomes unknown after this many consecutive rounds
+	// without a successful sample. Defaults to 3.
+	LatencyMaxFailures int
+
+	// A region moves to a PoP of lower latency only once it has been better
+	// than the current one by this fraction for SwitchRounds consecutive
+	// measurement rounds. Default to 0.1 and 2.
+	SwitchMargin float64
+	SwitchRounds int
+
+	// A PoP turning between healthy and erroring FlapThreshold times within
+	// FlapWindow is held down, i.e. treated as erroring, for FlapHoldDown
+	// since its last turn. Default to 3, 10 minutes and 5 minutes.
+	FlapThreshold int
+	FlapWindow    time.Duration
+	FlapHoldDown  time.Duration
+
+	// Intervals between the rounds of PoP status fetches, and of latency
+	// measurements. Default to 30 seconds.
+	StatusInterval  time.Duration
+	LatencyInterval time.Duration
+
+	// Timeouts of each PoP status fetch, and of each latency probe. Default
+	// to 5 and 10 seconds.
+	StatusTimeout time.Duration
+	ProbeTimeout  time.Duration
+
+	// Up to this much random delay is added to each interval, so that GSLB
+	// instances sharing the probers don't probe in lockstep.
+	Jitter time.Duration
+
+	// If set, the measurements are saved to the file every
+	// StateSaveInterval (defaults to a minute), and restored from it on
+	// startup unless older than StateMaxAge (defaults to 10 minutes).
+	StateFile         string
+	StateSaveInterval time.Duration
+	StateMaxAge       time.Duration
+
+	// If non-zero, the latency observed by real users, as reported to the
+	// /rum endpoint of HTTPServer, is blended into the latency measured by
+	// the probers with this weight. It takes effect once a region has
+	// RUMMinSamples beacons for a PoP within RUMWindow. Default to 10 and
+	// 10 minutes.
+	RUMWeight     float64
+	RUMMinSamples int
+	RUMWindow     time.Duration
+
+	// The latest QueryLogSize DNS decisions, defaulting to 1000, are kept
+	// in memory. If QueryLogFile is set, all of them are also appended to
+	// it as JSON lines, and Run fails unless it can be opened.
+	QueryLogSize int
+	QueryLogFile string
+
+	// Maximum number of PoP status fetches, and of latency probes, in
+	// flight at a time. Defaults to 16. It should exceed the number of PoPs,
+	// so that a stuck prober can't hold up the other regions until its
+	// probes time out.
+	ProbeConcurrency int
+
+	// Number of PoPs answered to each query, most preferred first, so that
+	// clients have a fallback. Defaults to 1. Services may override it.
+	Answers int
+
+	// Answers whose latency is within this fraction of each other are
+	// shuffled, so that clients preferring the first answer spread over
+	// near-equal PoPs. A first answer the policy picked over the nearest PoP
+	// stays first. Zero keeps the order of the policy.
+	ShuffleMargin float64
+
+	// Decides which PoP to answer each query with. Defaults to
+	// SpilloverPolicy. Services may override it.
+	Policy Policy
+
+	// The names answered by the GSLB. Defaults to a single "www" service of
+	// all PoPs.
+	Services []Service
+
 	FetchPoPStatus      FetchPoPStatusFunc
 	MakeLatencyMeasurer MakeLatencyMeasurerFunc
+	CheckHealth         CheckHealthFunc
+
+	// If set, called with the result of every PoP status fetch, latency
+	// probe and health check, e.g. to export metrics. It must not block.
+	ObserveProbe ObserveProbeFunc
+
+	// Returns the current time, by which overrides expire, PoPs are held
+	// down, and so on. Defaults to time.Now.
+	Now func() time.Time
+
+	// Waits out the intervals between the rounds of Run. Defaults to
+	// time.After.
+	After func(d time.Duration) <-chan time.Time
 }
 
 type RegionState struct {
 	info       types.RegionInfo
-	popLatency []float64
+	popLatency []Latency
+
+	// The PoP the region is settled on, or -1.
+	preferred int
+
+	// Only accessed by UpdateLatency.
+	estimators []latencyEstimator
+	// The PoP beating the preferred one, for `streak` rounds so far.
+	challenger int
+	streak     int
 }
 
 type GslbCore struct {
@@ -48,12 +177,43 @@ type GslbCore struct {
 
 	// pluggable for testing purposes.
 	fetchPoPStatus FetchPoPStatusFunc
+	checkHealth    CheckHealthFunc
+	observeProbe   ObserveProbeFunc
+	now            func() time.Time
+	after          func(d time.Duration) <-chan time.Time
+
+	// shouldn't be changed over lifetime of GslbCore, except for the health
+	// check results guarded by `mu`.
+	services []*serviceState
+
+	probeConcurrency int
+
+	switchMargin float64
+	switchRounds int
+
+	// Guarded by `mu`, since CarryOver reads them while prev is running.
+	flapDampers []flapDamper
+
+	// The log of the DNS decisions, guarded by its own lock.
+	queryLog *queryLog
+
+	// The latency observed by real users, guarded by its own lock. Nil
+	// unless cfg.RUMWeight is set.
+	rum *rumState
 
 	// Updated by the `GslbCore.Run()` worker. Access to the fields below should be guarded by `mu`.
 	mu       sync.Mutex
 	popstate []*types.PoPStatus
 	regions  []*RegionState
 	serial   uint32
+
+	// overrides[i] is the manual override of the i-th PoP, if its Mode is set.
+	overrides []Override
+
+	// compiled from cfg.Regions and the prefixes loaded from their sources.
+	regionTrie *regionTrie
+	// sourcePrefixes[i][j] is the prefixes loaded from cfg.Regions[i].PrefixSources[j].
+	sourcePrefixes [][][]netip.Prefix
 }
 
 func New(cfg *Config) *GslbCore {
@@ -64,78 +224,234 @@ func New(cfg *Config) *GslbCore {
 
 	mlm := cfg.MakeLatencyMeasurer
 	if mlm == nil {
-		mlm = func(proberURL, secret string) LatencyMeasurer {
+		mlm = func(region types.RegionInfo, secret string) LatencyMeasurer {
+			phase, err := ParseProbePhase(region.LatencyPhase)
+			if err != nil {
+				slog.Error("Measuring the time to first byte instead",
+					slog.String("region.Id", region.Id),
+					slog.String("error", err.Error()))
+				phase = PhaseFirstByte
+			}
 			return ProbeOverJSONRPC{
-				ProberURL: proberURL,
+				ProberURL: region.ProberURL,
 				Secret:    secret,
+				Phase:     phase,
 			}
 		}
 	}
 
+	policy := cfg.Policy
+	if policy == nil {
+		policy = &SpilloverPolicy{}
+	}
+
+	checkHealth := cfg.CheckHealth
+	if checkHealth == nil {
+		checkHealth = CheckHealthOverHTTP
+	}
+
+	observeProbe := cfg.ObserveProbe
+	if observeProbe == nil {
+		observeProbe = func(ProbeResult) {}
+	}
+
+	now := cfg.Now
+	if now == nil {
+		now = time.Now
+	}
+	after := cfg.After
+	if after == nil {
+		after = time.After
+	}
+
 	c := &GslbCore{
 		cfg: cfg,
 
 		fetchPoPStatus:   fps,
+		checkHealth:      checkHealth,
+		observeProbe:     observeProbe,
+		now:              now,
+		after:            after,
+		services:         newServiceStates(cfg, policy),
 		latencyMeasurers: make([]LatencyMeasurer, len(cfg.Regions)),
+		probeConcurrency: cmp.Or(cfg.ProbeConcurrency, 16),
+		switchMargin:     cmp.Or(cfg.SwitchMargin, 0.1),
+		switchRounds:     cmp.Or(cfg.SwitchRounds, 2),
+		flapDampers:      make([]flapDamper, len(cfg.Pops)),
+
+		popstate:  make([]*types.PoPStatus, len(cfg.Pops)),
+		regions:   make([]*RegionState, len(cfg.Regions)),
+		serial:    0,
+		overrides: make([]Override, len(cfg.Pops)),
+
+		queryLog: newQueryLog(cmp.Or(cfg.QueryLogSize, 1000), cfg.QueryLogFile != "", now()),
 
-		popstate: make([]*types.PoPStatus, len(cfg.Pops)),
-		regions:  make([]*RegionState, len(cfg.Regions)),
-		serial:   0,
+		regionTrie: newRegionTrie(cfg.Regions),
 	}
 	for i := range c.popstate {
 		c.popstate[i] = &types.PoPStatus{
 			Error: "not yet available",
 		}
+		c.flapDampers[i] = flapDamper{
+			threshold: cmp.Or(cfg.FlapThreshold, 3),
+			window:    cmp.Or(cfg.FlapWindow, 10*time.Minute),
+			holdDown:  cmp.Or(cfg.FlapHoldDown, 5*time.Minute),
+		}
 	}
 	for i, r := range cfg.Regions {
-		c.latencyMeasurers[i] = mlm(r.ProberURL, cfg.ProberSecret)
+		c.latencyMeasurers[i] = mlm(r, cfg.ProberSecret)
 
-		popLatency := make([]float64, len(c.cfg.Pops))
-		for j := range popLatency {
-			// initialize to a large value
-			popLatency[j] = 10000000
+		estimators := make([]latencyEstimator, len(c.cfg.Pops))
+		for j := range estimators {
+			estimators[j] = latencyEstimator{
+				alpha:       cmp.Or(cfg.LatencyAlpha, 0.3),
+				maxFailures: cmp.Or(cfg.LatencyMaxFailures, 3),
+			}
 		}
 
 		c.regions[i] = &RegionState{
 			info:       r, // copied for convienience
-			popLatency: popLatency,
+			popLatency: make([]Latency, len(c.cfg.Pops)),
+			preferred:  -1,
+			estimators: estimators,
+			challenger: -1,
+		}
+	}
+
+	if cfg.RUMWeight > 0 {
+		c.rum = newRUMState(cfg)
+		for i, lm := range c.latencyMeasurers {
+			c.latencyMeasurers[i] = &BlendedMeasurer{
+				Prober:     lm,
+				RUMLatency: func(endpointUrl string) (float64, int) { return c.rumLatency(i, endpointUrl) },
+				Weight:     cfg.RUMWeight,
+				MinSamples: cmp.Or(cfg.RUMMinSamples, 10),
+			}
+		}
+	}
+
+	if cfg.StateFile != "" {
+		if err := c.restoreState(cmp.Or(cfg.StateMaxAge, 10*time.Minute)); err != nil {
+			slog.Warn("Starting without the saved GSLB state", slog.String("error", err.Error()))
 		}
 	}
 
 	return c
 }
 
+// Run measures the PoPs until ctx is done. It returns once all of its
+// workers, including the HTTP server, have stopped, so that a reloaded
+// GslbCore can take over.
 func (c *GslbCore) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// Fail rather than run with the entries of the query log dropped.
+	var queryLogFile *os.File
+	if c.cfg.QueryLogFile != "" {
+		f, err := OpenQueryLogFile(c.cfg.QueryLogFile)
+		if err != nil {
+			return err
+		}
+		queryLogFile = f
+	}
+
 	if c.cfg.HTTPServer != "" {
-		if err := c.spawnHTTPServer(ctx); err != nil {
+		if err := c.spawnHTTPServer(ctx, &wg); err != nil {
+			if queryLogFile != nil {
+				queryLogFile.Close()
+			}
 			return err
 		}
 	}
 
-	for {
-		ctxU, cancel := context.WithTimeout(ctx, 10*time.Second)
-		c.UpdatePoPStatus(ctxU)
-		cancel()
+	if slices.ContainsFunc(c.cfg.Regions, func(r types.RegionInfo) bool { return len(r.PrefixSources) > 0 }) {
+		wg.Go(func() { c.runPrefixReload(ctx) })
+	}
 
-		ctxUL, cancel := context.WithTimeout(ctx, 30*time.Second)
-		c.UpdateLatency(ctxUL)
-		cancel()
+	if c.cfg.StateFile != "" {
+		wg.Go(func() { c.runStateSave(ctx, cmp.Or(c.cfg.StateSaveInterval, time.Minute)) })
+	}
 
-		// sleep for 30 seconds, or stop running if the context is done
-		select {
-		case <-time.After(30 * time.Second):
-			break
+	if queryLogFile != nil {
+		wg.Go(func() { c.queryLog.runFileWriter(ctx, queryLogFile) })
+	}
+
+	// Measure the latency once the health of the PoPs is known, so that
+	// the regions settle on healthy PoPs.
+	c.UpdatePoPStatus(ctx)
+
+	wg.Go(func() {
+		c.runLoop(ctx, cmp.Or(c.cfg.StatusInterval, 30*time.Second), c.UpdatePoPStatus)
+	})
+	wg.Go(func() {
+		c.UpdateLatency(ctx)
+		c.runLoop(ctx, cmp.Or(c.cfg.LatencyInterval, 30*time.Second), c.UpdateLatency)
+	})
+	wg.Wait()
+
+	err := ctx.Err()
+	if !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
 
+// runLoop calls update every interval plus jitter, until ctx is done.
+func (c *GslbCore) runLoop(ctx context.Context, interval time.Duration, update func(ctx context.Context)) {
+	for {
+		d := interval
+		if c.cfg.Jitter > 0 {
+			d += rand.N(c.cfg.Jitter)
+		}
+
+		select {
+		case <-c.after(d):
 		case <-ctx.Done():
-			err := ctx.Err()
-			if !errors.Is(err, context.Canceled) {
-				return err
-			}
-			return nil
+			return
+		}
+
+		update(ctx)
+	}
+}
+
+// fetchPoPStatusOnce fetches the status of the i-th PoP, and applies the
+// flap damping to it.
+func (c *GslbCore) fetchPoPStatusOnce(ctx context.Context, i int) *types.PoPStatus {
+	pop := c.cfg.Pops[i]
+
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(c.cfg.StatusTimeout, 5*time.Second))
+	defer cancel()
+
+	slog.Info("Fetching PoP status", slog.String("pop.Id", pop.Id))
+	start := time.Now()
+	ps, err := c.fetchPoPStatus(ctx, AnyFamily.Addr(pop))
+	c.observeProbe(ProbeResult{Kind: ProbeStatus, PopId: pop.Id, Took: time.Since(start), Err: err})
+	if err != nil {
+		slog.Error("PoP status fetch failed with error", slog.String("pop.Id", pop.Id), slog.String("error", err.Error()))
+		ps = &types.PoPStatus{
+			Error: err.Error(),
 		}
 	}
+
+	c.mu.Lock()
+	d := &c.flapDampers[i]
+	heldDown, until := d.observe(ps.Error == "", c.now()), d.holdDownUntil
+	c.mu.Unlock()
+	if heldDown && ps.Error == "" {
+		slog.Warn("Holding down flapping PoP",
+			slog.String("pop.Id", pop.Id),
+			slog.Time("until", until))
+		held := *ps
+		held.Error = fmt.Sprintf("held down for flapping until %s", until.Format(time.RFC3339))
+		ps = &held
+	}
+	return ps
 }
 
+// UpdatePoPStatus fetches the status of the PoPs, and runs the health checks
+// of the services, concurrently. Each result is published as it arrives, and
+// the serial is bumped once all of them are.
 func (c *GslbCore) UpdatePoPStatus(ctx context.Context) {
 	slog.Info("UpdatePoPStatus start")
 	start := time.Now()
@@ -143,27 +459,164 @@ func (c *GslbCore) UpdatePoPStatus(ctx context.Context) {
 		slog.Info("UpdatePoPStatus done", slog.Duration("took", time.Since(start)))
 	}()
 
-	newstate := make([]*types.PoPStatus, len(c.cfg.Pops))
-	for i, pop := range c.cfg.Pops {
-		slog.Info("Fetching PoP status", slog.String("pop.Id", pop.Id))
-		ps, err := c.fetchPoPStatus(ctx, pop.Ip4)
-		if err != nil {
-			slog.Error("PoP status fetch failed with error", slog.String("pop.Id", pop.Id), slog.String("error", err.Error()))
-			newstate[i] = &types.PoPStatus{
-				Error: err.Error(),
-			}
+	sem := make(chan struct{}, c.probeConcurrency)
+	var wg sync.WaitGroup
+	for i := range c.cfg.Pops {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			ps := c.fetchPoPStatusOnce(ctx, i)
+			<-sem
+
+			// popstate is shared with in-flight queries. Replace it instead
+			// of modifying it.
+			c.mu.Lock()
+			popstate := slices.Clone(c.popstate)
+			popstate[i] = ps
+			c.popstate = popstate
+			c.mu.Unlock()
+		}()
+	}
+	for _, s := range c.services {
+		if s.info.HealthCheckUrl == "" {
 			continue
 		}
+		for i := range c.cfg.Pops {
+			if !s.inPool[i] {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				sem <- struct{}{}
+				err := c.checkServiceHealthOnce(ctx, s, i)
+				<-sem
+
+				c.mu.Lock()
+				checkErr := slices.Clone(s.checkErr)
+				checkErr[i] = ""
+				if err != nil {
+					checkErr[i] = err.Error()
+				}
+				s.checkErr = checkErr
+				c.mu.Unlock()
+			}()
+		}
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	c.serial++
+	c.mu.Unlock()
+}
 
-		newstate[i] = ps
+func (c *GslbCore) runPrefixReload(ctx context.Context) {
+	interval := c.cfg.PrefixReloadInterval
+	if interval <= 0 {
+		interval = time.Hour
 	}
 
 	c.mu.Lock()
-	c.popstate = newstate
+	loaded := c.sourcePrefixes != nil
+	c.mu.Unlock()
+
+	for {
+		if loaded {
+			select {
+			case <-c.after(interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+		loaded = true
+
+		if err := c.ReloadPrefixes(); err != nil {
+			slog.Error("Failed to reload region prefixes", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// ReloadPrefixes loads the prefix sources of the regions, and recompiles the
+// region lookup. A source failing to load keeps the prefixes loaded from it
+// previously.
+func (c *GslbCore) ReloadPrefixes() error {
+	slog.Info("ReloadPrefixes start")
+	start := time.Now()
+	defer func() {
+		slog.Info("ReloadPrefixes done", slog.Duration("took", time.Since(start)))
+	}()
+
+	c.mu.Lock()
+	prevLoaded := c.sourcePrefixes
+	c.mu.Unlock()
+
+	var errs []error
+	regions := slices.Clone(c.cfg.Regions)
+	loaded := make([][][]netip.Prefix, len(regions))
+	for i := range regions {
+		r := &regions[i]
+		r.Prefixes = slices.Clone(r.Prefixes)
+		loaded[i] = make([][]netip.Prefix, len(r.PrefixSources))
+		for j, src := range r.PrefixSources {
+			ps, err := LoadPrefixSource(src)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("region %q: %v", r.Id, err))
+				if prevLoaded != nil {
+					ps = prevLoaded[i][j]
+				}
+			}
+			loaded[i][j] = ps
+			r.Prefixes = append(r.Prefixes, ps...)
+		}
+		slog.Info("Loaded region prefixes", slog.String("region.Id", r.Id), slog.Int("prefixes", len(r.Prefixes)))
+	}
+	trie := newRegionTrie(regions)
+
+	c.mu.Lock()
+	c.regionTrie = trie
+	c.sourcePrefixes = loaded
 	c.serial++
 	c.mu.Unlock()
+
+	return errors.Join(errs...)
 }
 
+// measurePopLatency takes the samples of a round from the region to the PoP.
+func (c *GslbCore) measurePopLatency(ctx context.Context, regionIdx, popIdx int) []float64 {
+	lm := c.latencyMeasurers[regionIdx]
+	pop := c.cfg.Pops[popIdx]
+
+	var samples []float64
+	for range cmp.Or(c.cfg.LatencySamples, 3) {
+		ctx, cancel := context.WithTimeout(ctx, cmp.Or(c.cfg.ProbeTimeout, 10*time.Second))
+		start := time.Now()
+		lat, err := lm.MeasureLatency(ctx, pop.LatencyEndpointUrl)
+		cancel()
+		c.observeProbe(ProbeResult{
+			Kind:     ProbeLatency,
+			PopId:    pop.Id,
+			RegionId: c.cfg.Regions[regionIdx].Id,
+			Took:     time.Since(start),
+			Err:      err,
+		})
+		if err != nil {
+			slog.Error("Failed to measure latency",
+				slog.String("latencyMeasurer", lm.DebugString()),
+				slog.String("pop.Id", pop.Id),
+				slog.String("error", err.Error()))
+			continue
+		}
+		samples = append(samples, lat)
+	}
+	return samples
+}
+
+// UpdateLatency measures the latency from each region to each PoP
+// concurrently. A region is published, and the serial bumped, as soon as
+// all of its PoPs are measured.
 func (c *GslbCore) UpdateLatency(ctx context.Context) {
 	slog.Info("UpdateLatency start")
 	start := time.Now()
@@ -171,26 +624,39 @@ func (c *GslbCore) UpdateLatency(ctx context.Context) {
 		slog.Info("UpdateLatency done", slog.Duration("took", time.Since(start)))
 	}()
 
+	sem := make(chan struct{}, c.probeConcurrency)
+	var wg sync.WaitGroup
 	for i, lm := range c.latencyMeasurers {
-		slog.Info("Measuring latency from prober", slog.String("latencyMeasurer", lm.DebugString()))
-
-		popLatency := make([]float64, len(c.cfg.Pops))
-		for j := range popLatency {
-			lat, err := lm.MeasureLatency(ctx, c.cfg.Pops[j].LatencyEndpointUrl)
-			if err != nil {
-				slog.Error("Failed to measure latency",
-					slog.String("latencyMeasurer", lm.DebugString()),
-					slog.String("error", err.Error()))
-				lat = 20000000 // random long latancy
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slog.Info("Measuring latency from prober", slog.String("latencyMeasurer", lm.DebugString()))
+
+			popLatency := make([]Latency, len(c.cfg.Pops))
+			var popWg sync.WaitGroup
+			for j := range popLatency {
+				popWg.Add(1)
+				go func() {
+					defer popWg.Done()
+
+					sem <- struct{}{}
+					samples := c.measurePopLatency(ctx, i, j)
+					<-sem
+
+					popLatency[j] = c.regions[i].estimators[j].update(samples, c.cfg.LatencyTrim)
+				}()
 			}
-			popLatency[j] = lat
-		}
-
-		c.mu.Lock()
-		c.regions[i].popLatency = popLatency
-		c.serial++
-		c.mu.Unlock()
+			popWg.Wait()
+
+			c.mu.Lock()
+			c.regions[i].popLatency = popLatency
+			healthy, _ := c.healthyLocked(nil, AnyFamily)
+			c.updatePreferredLocked(c.regions[i], healthy)
+			c.serial++
+			c.mu.Unlock()
+		}()
 	}
+	wg.Wait()
 }
 
 func (c *GslbCore) Serial() uint32 {
@@ -202,7 +668,7 @@ func (c *GslbCore) Serial() uint32 {
 
 func (c *GslbCore) PopIdFromIP(ip netip.Addr) string {
 	for _, pop := range c.cfg.Pops {
-		if pop.Ip4.Compare(ip) == 0 {
+		if pop.Ip4 == ip || pop.Ip6 == ip {
 			return pop.Id
 		}
 	}
@@ -210,12 +676,229 @@ func (c *GslbCore) PopIdFromIP(ip netip.Addr) string {
 	return "<not found>"
 }
 
-func (c *GslbCore) Query(srcIP netip.Addr) []netip.Addr {
-	slog.Info("Query", slog.String("srcIP", srcIP.String()))
+// findRegionLocked returns the index of the region with the longest prefix
+// containing ip, or -1 if there is none.
+func (c *GslbCore) findRegionLocked(ip netip.Addr) (int, netip.Prefix) {
+	return c.regionTrie.lookup(ip)
+}
+
+// healthyLocked returns whether each PoP can be answered for the service in
+// the family. A nil service stands for all PoPs regardless of the health
+// checks. Drained PoPs are unhealthy, and disabled ones never answered. If
+// no PoP of the pool is healthy, all of them are considered so, since
+// answering an erroring PoP is better than answering nothing.
+func (c *GslbCore) healthyLocked(s *serviceState, family Family) (healthy []bool, failOpen bool) {
+	now := c.now()
+	candidate := make([]bool, len(c.popstate))
+	healthy = make([]bool, len(c.popstate))
+	for i, ps := range c.popstate {
+		o := c.overrides[i]
+		active := o.activeAt(now)
+		candidate[i] = family.Has(c.cfg.Pops[i]) && (s == nil || s.inPool[i]) &&
+			!(active && o.Mode == OverrideDisable)
+		healthy[i] = candidate[i] && ps.Error == "" && (s == nil || s.checkErr[i] == "") &&
+			!(active && o.Mode == OverrideDrain)
+	}
+	if !slices.Contains(healthy, true) {
+		return candidate, true
+	}
+	return healthy, false
+}
+
+// defaultLatencyLocked returns the latency to each PoP for clients not in
+// any region, averaged over the regions where it is known.
+func (c *GslbCore) defaultLatencyLocked() []Latency {
+	avgLatency := make([]Latency, len(c.cfg.Pops))
+	for i := range avgLatency {
+		sum, n := 0.0, 0
+		for _, r := range c.regions {
+			if r.popLatency[i].Known {
+				sum += r.popLatency[i].Value
+				n++
+			}
+		}
+		if n > 0 {
+			avgLatency[i] = Latency{Value: sum / float64(n), Known: true}
+		}
+	}
+	return avgLatency
+}
 
+// RegionLatency returns the latency from the region to each PoP.
+func (c *GslbCore) RegionLatency(regionId string) ([]Latency, bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// FIXME(student): Implement your own query logic
-	return []netip.Addr{c.cfg.Pops[0].Ip4}
+	for _, r := range c.regions {
+		if r.info.Id == regionId {
+			return slices.Clone(r.popLatency), true
+		}
+	}
+	return nil, false
+}
+
+// Family is the address family of the answers to a query.
+type Family int
+
+const (
+	AnyFamily Family = 0
+	IPv4      Family = 4
+	IPv6      Family = 6
+)
+
+// Addr returns the address of the PoP in the family, which is invalid if
+// the PoP has none. AnyFamily prefers the IPv4 address.
+func (f Family) Addr(pop types.PoPInfo) netip.Addr {
+	switch f {
+	case IPv4:
+		return pop.Ip4
+	case IPv6:
+		return pop.Ip6
+	default:
+		if pop.Ip4.IsValid() {
+			return pop.Ip4
+		}
+		return pop.Ip6
+	}
+}
+
+// Has returns whether the PoP has an address in the family.
+func (f Family) Has(pop types.PoPInfo) bool {
+	return f.Addr(pop).IsValid()
+}
+
+// decision is how a query is answered, kept around for Explain.
+type decision struct {
+	svc      *serviceState
+	family   Family
+	snapshot *Snapshot
+	prefix   netip.Prefix
+
+	// Whether no PoP of the pool was healthy, so that all were answerable.
+	failOpen bool
+	// The overrides, health check results and weights at the query.
+	overrides []Override
+	checkErr  []string
+	weights   []float64
+
+	// The PoPs the policy selected, after weighing, and the answered ones.
+	selected []int
+	answers  []int
+}
+
+// decide answers srcIP for the service, or returns nil if the service is
+// unknown.
+func (c *GslbCore) decide(service string, srcIP netip.Addr, family Family) *decision {
+	svc := c.service(service)
+	if svc == nil {
+		return nil
+	}
+	d := &decision{svc: svc, family: family}
+
+	now := c.now()
+	c.mu.Lock()
+	regionIdx, prefix := c.findRegionLocked(srcIP)
+	healthy, failOpen := c.healthyLocked(svc, family)
+	s := &Snapshot{
+		Pops:      c.cfg.Pops,
+		PoPStatus: c.popstate,
+		Healthy:   healthy,
+	}
+	if regionIdx == -1 {
+		s.Latency = c.defaultLatencyLocked()
+		s.Preferred = c.cfg.DefaultPop
+	} else {
+		s.Region = &c.cfg.Regions[regionIdx]
+		s.Latency = c.regions[regionIdx].popLatency
+		if p := c.regions[regionIdx].preferred; p != -1 {
+			s.Preferred = c.cfg.Pops[p].Id
+		}
+	}
+	d.snapshot, d.prefix, d.failOpen = s, prefix, failOpen
+	d.overrides = slices.Clone(c.overrides)
+	d.checkErr = svc.checkErr
+	d.weights = c.weightsLocked(now)
+	c.mu.Unlock()
+
+	if !svc.serves(c.cfg.Pops, family) {
+		return d
+	}
+
+	// popstate and popLatency are replaced, not modified, on updates, so the
+	// policy can look at them without holding `mu`.
+	selected := svc.policy.Select(s, srcIP)
+	// Policies may answer unhealthy PoPs, but never ones without an address,
+	// out of the pool, or disabled.
+	selected = slices.DeleteFunc(selected, func(i int) bool {
+		return !family.Has(c.cfg.Pops[i]) || !svc.inPool[i] || d.weights[i] == 0
+	})
+	d.selected = demoteWeighted(selected, c.cfg.Pops, d.weights, srcIP)
+
+	answers := d.selected[:min(len(d.selected), svc.answers)]
+	if c.cfg.ShuffleMargin > 0 && len(answers) > 0 {
+		// The first answer stays first if it was picked over the nearest
+		// PoP, e.g. by spilling over, so that the shuffle doesn't undo the
+		// policy.
+		first := 0
+		if ranked := s.Ranked(); len(ranked) == 0 || ranked[0] != answers[0] {
+			first = 1
+		}
+		answers = slices.Concat(answers[:first], shuffleNearEqual(answers[first:], s.Latency, c.cfg.ShuffleMargin))
+	}
+	d.answers = answers
+	return d
+}
+
+// Query returns the addresses in the family of the PoPs to answer srcIP
+// with for the service. PoPs without an address in the family, or out of
+// the pool of the service, are never answered.
+func (c *GslbCore) Query(service string, srcIP netip.Addr, family Family) []netip.Addr {
+	ips, _ := c.query(service, srcIP, family)
+	return ips
+}
+
+// query is Query, also returning the decision, or nil if the service is
+// unknown.
+func (c *GslbCore) query(service string, srcIP netip.Addr, family Family) ([]netip.Addr, *decision) {
+	slog.Info("Query",
+		slog.String("service", service),
+		slog.String("srcIP", srcIP.String()),
+		slog.Int("family", int(family)))
+
+	d := c.decide(service, srcIP, family)
+	if d == nil {
+		slog.Warn("Query for an unknown service", slog.String("service", service))
+		return nil, nil
+	}
+	if len(d.answers) == 0 {
+		if d.svc.serves(c.cfg.Pops, family) {
+			slog.Error("Policy selected no PoP", slog.String("policy", d.svc.policy.Name()))
+		}
+		return nil, d
+	}
+
+	popIds := make([]string, len(d.answers))
+	ips := make([]netip.Addr, len(d.answers))
+	for i, popIdx := range d.answers {
+		popIds[i] = c.cfg.Pops[popIdx].Id
+		ips[i] = family.Addr(c.cfg.Pops[popIdx])
+	}
+
+	if d.snapshot.Region == nil {
+		slog.Info("No region matched, answering the default PoP",
+			slog.String("srcIP", srcIP.String()),
+			slog.String("service", d.svc.info.Name),
+			slog.String("policy", d.svc.policy.Name()),
+			slog.Any("pop.Ids", popIds))
+	} else {
+		slog.Info("Answering the selected PoP",
+			slog.String("srcIP", srcIP.String()),
+			slog.String("region.Id", d.snapshot.Region.Id),
+			slog.String("prefix", d.prefix.String()),
+			slog.String("service", d.svc.info.Name),
+			slog.String("policy", d.svc.policy.Name()),
+			slog.Any("pop.Ids", popIds))
+	}
+
+	return ips, d
 }
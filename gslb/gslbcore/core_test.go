@@ -4,8 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/netip"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,6 +16,28 @@ import (
 	"github.com/yzp0n/ncdn/types"
 )
 
+// testLatency[proberURL][endpointUrl] is the latency reported by testLatencyMeasurer.
+var testLatency = map[string]map[string]float64{
+	"https://203.0.113.10:8443/probe": {
+		"http://192.0.2.1/latencyz":   100,
+		"http://192.0.2.2/latencyz":   50,
+		"http://192.0.2.3/latencyz":   80,
+		"http://192.0.2.254/latencyz": 10,
+	},
+	"https://203.0.113.20:8443/probe": {
+		"http://192.0.2.1/latencyz":   30,
+		"http://192.0.2.2/latencyz":   60,
+		"http://192.0.2.3/latencyz":   90,
+		"http://192.0.2.254/latencyz": 20,
+	},
+	"https://203.0.113.30:8443/probe": {
+		"http://192.0.2.1/latencyz":   7,
+		"http://192.0.2.2/latencyz":   6,
+		"http://192.0.2.3/latencyz":   5,
+		"http://192.0.2.254/latencyz": 300,
+	},
+}
+
 type testLatencyMeasurer struct {
 	ProberURL string
 }
@@ -22,11 +47,75 @@ func (m *testLatencyMeasurer) DebugString() string {
 }
 
 func (m *testLatencyMeasurer) MeasureLatency(ctx context.Context, url string) (float64, error) {
-	return 0.123, nil
+	lat, ok := testLatency[m.ProberURL][url]
+	if !ok {
+		return 0, fmt.Errorf("no test latency for %s", url)
+	}
+	return lat, nil
 }
 
-func TestGslbCore(t *testing.T) {
-	cfg := &gslbcore.Config{
+// testClock is the time of a GslbCore, advanced by the test at will.
+type testClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []clockWaiter
+}
+
+type clockWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newTestClock() *testClock {
+	c := &testClock{now: time.Date(2024, 8, 12, 9, 0, 0, 0, time.UTC)}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := clockWaiter{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	c.cond.Broadcast()
+	return w.c
+}
+
+// Advance moves the time forward, firing the waiters due by then.
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	c.waiters = slices.DeleteFunc(c.waiters, func(w clockWaiter) bool {
+		if w.at.After(c.now) {
+			return false
+		}
+		w.c <- c.now
+		return true
+	})
+}
+
+// WaitForWaiters blocks until n calls of After are waiting.
+func (c *testClock) WaitForWaiters(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
+
+func newTestConfig() *gslbcore.Config {
+	return &gslbcore.Config{
 		Pops: []types.PoPInfo{
 			{
 				Id:                 "shinjuku",
@@ -70,6 +159,7 @@ func TestGslbCore(t *testing.T) {
 				Id: "tokyo",
 				Prefixes: []netip.Prefix{
 					netip.MustParsePrefix("198.51.100.32/28"),
+					netip.MustParsePrefix("198.51.100.0/24"),
 				},
 				ProberURL: "https://203.0.113.30:8443/probe",
 			},
@@ -88,10 +178,16 @@ func TestGslbCore(t *testing.T) {
 
 			return ps, nil
 		},
-		MakeLatencyMeasurer: func(proberURL, secret string) gslbcore.LatencyMeasurer {
-			return &testLatencyMeasurer{ProberURL: proberURL}
+		MakeLatencyMeasurer: func(region types.RegionInfo, secret string) gslbcore.LatencyMeasurer {
+			return &testLatencyMeasurer{ProberURL: region.ProberURL}
 		},
 	}
+}
+
+// startTestCore runs a GslbCore until the test ends, and waits for its
+// first round of measurements.
+func startTestCore(t *testing.T, cfg *gslbcore.Config) *gslbcore.GslbCore {
+	t.Helper()
 
 	c := gslbcore.New(cfg)
 
@@ -107,7 +203,7 @@ func TestGslbCore(t *testing.T) {
 		cancel()
 		<-joinC
 	})
-	defer cleanup()
+	t.Cleanup(cleanup)
 
 	// Wait until the first UpdatePoPStatus is done.
 	for {
@@ -126,21 +222,362 @@ func TestGslbCore(t *testing.T) {
 		}
 	}
 
+	return c
+}
+
+func TestGslbCore(t *testing.T) {
+	c := startTestCore(t, newTestConfig())
+
 	testcases := []struct {
 		Name     string
 		SrcIPStr string
+		Want     []string
 	}{
 		{
+			// atlantis is nearer, but down.
 			Name:     "us-west-0",
 			SrcIPStr: "198.51.100.12",
+			Want:     []string{"192.0.2.2"},
+		},
+		{
+			Name:     "us-west-1",
+			SrcIPStr: "198.51.100.200",
+			Want:     []string{"192.0.2.2"},
+		},
+		{
+			Name:     "us-east-0",
+			SrcIPStr: "198.51.100.70",
+			Want:     []string{"192.0.2.1"},
+		},
+		{
+			Name:     "tokyo-0",
+			SrcIPStr: "198.51.100.40",
+			Want:     []string{"192.0.2.3"},
+		},
+		{
+			// Only matches the tokyo /24.
+			Name:     "tokyo-1",
+			SrcIPStr: "198.51.100.250",
+			Want:     []string{"192.0.2.3"},
+		},
+		{
+			// Lowest average latency: shinjuku (45.7ms) vs shibuya (38.7ms) vs akiba (58.3ms).
+			Name:     "no-region",
+			SrcIPStr: "203.0.113.1",
+			Want:     []string{"192.0.2.2"},
 		},
 	}
 	for _, tc := range testcases {
 		t.Run(tc.Name, func(t *testing.T) {
 			srcIP := netip.MustParseAddr(tc.SrcIPStr)
-			rs := c.Query(srcIP)
+			rs := c.Query("www", srcIP, gslbcore.IPv4)
 			t.Logf("Query(%s): %v", srcIP, rs)
+
+			got := make([]string, len(rs))
+			for i, ip := range rs {
+				got[i] = ip.String()
+			}
+			if !slices.Equal(got, tc.Want) {
+				t.Errorf("Query(%s): got %v, want %v", srcIP, got, tc.Want)
+			}
 		})
 	}
+}
+
+func TestGslbCoreSpillover(t *testing.T) {
+	cfg := newTestConfig()
+	// Loads reported by the test PoPs are 1, 2 and 3 RPS respectively.
+	cfg.Pops[1].Capacity = 2.2 // shibuya: above the spillover threshold
+	cfg.Pops[2].Capacity = 3   // akiba: saturated
+	c := startTestCore(t, cfg)
+
+	testcases := []struct {
+		Name   string
+		Prefix string
+		// Each of the PoPs should get some of the clients, and the rest none.
+		WantSome []string
+	}{
+		{
+			Name:     "us-west",
+			Prefix:   "198.51.100.0/28",
+			WantSome: []string{"192.0.2.2", "192.0.2.1"},
+		},
+		{
+			Name:     "tokyo",
+			Prefix:   "198.51.100.32/28",
+			WantSome: []string{"192.0.2.2", "192.0.2.1"},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			counts := make(map[string]int)
+			prefix := netip.MustParsePrefix(tc.Prefix)
+			for ip := prefix.Addr(); prefix.Contains(ip); ip = ip.Next() {
+				rs := c.Query("www", ip, gslbcore.IPv4)
+				if len(rs) != 1 {
+					t.Fatalf("Query(%s): got %v, want 1 answer", ip, rs)
+				}
+				if again := c.Query("www", ip, gslbcore.IPv4); !slices.Equal(rs, again) {
+					t.Errorf("Query(%s) is not stable: got %v, then %v", ip, rs, again)
+				}
+				counts[rs[0].String()]++
+			}
+			t.Logf("answers: %v", counts)
+
+			for ip, n := range counts {
+				if !slices.Contains(tc.WantSome, ip) {
+					t.Errorf("%s got %d clients, want none", ip, n)
+				}
+			}
+			for _, ip := range tc.WantSome {
+				if counts[ip] == 0 {
+					t.Errorf("%s got no clients", ip)
+				}
+			}
+		})
+	}
+}
+
+// blockingLatencyMeasurer blocks until release is closed.
+type blockingLatencyMeasurer struct {
+	release chan struct{}
+}
+
+func (m *blockingLatencyMeasurer) DebugString() string {
+	return "blockingLatencyMeasurer"
+}
+
+func (m *blockingLatencyMeasurer) MeasureLatency(ctx context.Context, url string) (float64, error) {
+	select {
+	case <-m.release:
+		return 42, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func TestUpdateLatencyConcurrently(t *testing.T) {
+	blocking := &blockingLatencyMeasurer{release: make(chan struct{})}
+
+	cfg := newTestConfig()
+	// Leave room for the other regions while tokyo holds 4 slots.
+	cfg.ProbeConcurrency = 6
+	cfg.MakeLatencyMeasurer = func(region types.RegionInfo, secret string) gslbcore.LatencyMeasurer {
+		if region.ProberURL == cfg.Regions[2].ProberURL {
+			return blocking
+		}
+		return &testLatencyMeasurer{ProberURL: region.ProberURL}
+	}
+	c := gslbcore.New(cfg)
+
+	doneC := make(chan struct{})
+	go func() {
+		c.UpdateLatency(context.Background())
+		close(doneC)
+	}()
+
+	// us-west and us-east are published while tokyo is stuck.
+	for c.Serial() < 2 {
+		select {
+		case <-doneC:
+			t.Fatalf("UpdateLatency returned before tokyo was measured")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	for _, id := range []string{"us-west", "us-east", "tokyo"} {
+		lat, _ := c.RegionLatency(id)
+		if known := id != "tokyo"; lat[0].Known != known {
+			t.Errorf("%s: got latency %+v, want known=%v", id, lat[0], known)
+		}
+	}
+
+	close(blocking.release)
+	<-doneC
+	if got := c.Serial(); got != 3 {
+		t.Errorf("serial: got %d, want 3", got)
+	}
+	if lat, _ := c.RegionLatency("tokyo"); lat[0] != (gslbcore.Latency{Value: 42, Known: true}) {
+		t.Errorf("tokyo: got latency %+v, want 42", lat[0])
+	}
+}
+
+// countingLatencyMeasurer counts the probes made through it.
+type countingLatencyMeasurer struct {
+	testLatencyMeasurer
+	n *atomic.Int64
+}
+
+func (m *countingLatencyMeasurer) MeasureLatency(ctx context.Context, url string) (float64, error) {
+	m.n.Add(1)
+	return m.testLatencyMeasurer.MeasureLatency(ctx, url)
+}
+
+func TestRunIntervals(t *testing.T) {
+	var statusFetches, probes atomic.Int64
+
+	clock := newTestClock()
+	cfg := newTestConfig()
+	cfg.Now = clock.Now
+	cfg.After = clock.After
+	cfg.StatusInterval = 20 * time.Second
+	cfg.LatencyInterval = time.Hour
+	cfg.Jitter = 5 * time.Second
+	fetch := cfg.FetchPoPStatus
+	cfg.FetchPoPStatus = func(ctx context.Context, ip netip.Addr) (*types.PoPStatus, error) {
+		statusFetches.Add(1)
+		return fetch(ctx, ip)
+	}
+	cfg.MakeLatencyMeasurer = func(region types.RegionInfo, secret string) gslbcore.LatencyMeasurer {
+		return &countingLatencyMeasurer{testLatencyMeasurer{ProberURL: region.ProberURL}, &probes}
+	}
+	startTestCore(t, cfg)
+
+	// Each step is past the status interval plus jitter, but far from the
+	// latency interval. Both loops are waiting before each step.
+	for range 5 {
+		clock.WaitForWaiters(2)
+		clock.Advance(25 * time.Second)
+	}
+	clock.WaitForWaiters(2)
+
+	// 4 PoPs initially and every step, vs. 3 samples from 3 regions to 4
+	// PoPs once.
+	if n := statusFetches.Load(); n != 4*6 {
+		t.Errorf("got %d status fetches, want 24", n)
+	}
+	if n := probes.Load(); n != 3*3*4 {
+		t.Errorf("got %d latency probes, want 36", n)
+	}
+}
+
+func TestGslbCoreAnswers(t *testing.T) {
+	srcIP := netip.MustParseAddr("198.51.100.12") // us-west
+
+	t.Run("ordered", func(t *testing.T) {
+		cfg := newTestConfig()
+		cfg.Answers = 3
+		c := startTestCore(t, cfg)
+
+		// shibuya (50ms), akiba (80ms), shinjuku (100ms). atlantis is down.
+		want := []netip.Addr{
+			netip.MustParseAddr("192.0.2.2"),
+			netip.MustParseAddr("192.0.2.3"),
+			netip.MustParseAddr("192.0.2.1"),
+		}
+		if got := c.Query("www", srcIP, gslbcore.IPv4); !slices.Equal(got, want) {
+			t.Errorf("Query(%s): got %v, want %v", srcIP, got, want)
+		}
+	})
 
+	t.Run("shuffled", func(t *testing.T) {
+		cfg := newTestConfig()
+		cfg.Answers = 3
+		cfg.ShuffleMargin = 0.7 // shibuya and akiba are near-equal.
+		c := startTestCore(t, cfg)
+
+		firsts := make(map[string]int)
+		for range 100 {
+			got := c.Query("www", srcIP, gslbcore.IPv4)
+			if len(got) != 3 || got[2].String() != "192.0.2.1" {
+				t.Fatalf("Query(%s): got %v, want shinjuku last", srcIP, got)
+			}
+			firsts[got[0].String()]++
+		}
+		t.Logf("first answers: %v", firsts)
+		if firsts["192.0.2.2"] == 0 || firsts["192.0.2.3"] == 0 {
+			t.Errorf("first answers are not shuffled: %v", firsts)
+		}
+	})
+
+	t.Run("spilled-over", func(t *testing.T) {
+		cfg := newTestConfig()
+		cfg.Answers = 2
+		cfg.ShuffleMargin = 0.7  // shibuya and akiba are near-equal.
+		cfg.Pops[1].Capacity = 2 // shibuya is saturated.
+		c := startTestCore(t, cfg)
+
+		// The nearer shibuya never comes back first.
+		for range 100 {
+			got := c.Query("www", srcIP, gslbcore.IPv4)
+			if len(got) != 2 || got[0].String() != "192.0.2.3" {
+				t.Fatalf("Query(%s): got %v, want akiba first", srcIP, got)
+			}
+		}
+	})
+}
+
+func TestGslbCoreFamilies(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.Answers = 3
+	// shinjuku is v4-only, shibuya dual-stack, and akiba v6-only.
+	cfg.Pops[1].Ip6 = netip.MustParseAddr("2001:db8::2")
+	cfg.Pops[2].Ip4 = netip.Addr{}
+	cfg.Pops[2].Ip6 = netip.MustParseAddr("2001:db8::3")
+	cfg.Regions[0].Prefixes = append(cfg.Regions[0].Prefixes, netip.MustParsePrefix("2001:db8:1::/48"))
+	c := startTestCore(t, cfg)
+
+	testcases := []struct {
+		SrcIP  string
+		Family gslbcore.Family
+		Want   []string
+	}{
+		// us-west: shibuya (50ms), akiba (80ms), shinjuku (100ms).
+		{"198.51.100.12", gslbcore.IPv4, []string{"192.0.2.2", "192.0.2.1"}},
+		{"198.51.100.12", gslbcore.IPv6, []string{"2001:db8::2", "2001:db8::3"}},
+		{"2001:db8:1::1", gslbcore.IPv4, []string{"192.0.2.2", "192.0.2.1"}},
+		{"2001:db8:1::1", gslbcore.IPv6, []string{"2001:db8::2", "2001:db8::3"}},
+		{"::ffff:198.51.100.12", gslbcore.IPv6, []string{"2001:db8::2", "2001:db8::3"}},
+	}
+	for _, tc := range testcases {
+		srcIP := netip.MustParseAddr(tc.SrcIP)
+		got := c.Query("www", srcIP, tc.Family)
+		want := make([]netip.Addr, len(tc.Want))
+		for i, s := range tc.Want {
+			want[i] = netip.MustParseAddr(s)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("Query(%s, %d): got %v, want %v", srcIP, tc.Family, got, want)
+		}
+	}
+
+	if got := c.PopIdFromIP(netip.MustParseAddr("2001:db8::3")); got != "akiba" {
+		t.Errorf("PopIdFromIP(2001:db8::3): got %s, want akiba", got)
+	}
+
+	// No PoP has an IPv6 address.
+	v4only := newTestConfig()
+	if got := gslbcore.New(v4only).Query("www", netip.MustParseAddr("2001:db8:1::1"), gslbcore.IPv6); len(got) != 0 {
+		t.Errorf("Query of v4-only PoPs for IPv6: got %v, want none", got)
+	}
+}
+
+func TestRunReleasesHTTPServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	cfg := newTestConfig()
+	cfg.HTTPServer = addr
+	c := gslbcore.New(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := make(chan error)
+	go func() { errC <- c.Run(ctx) }()
+	for c.Serial() < uint32(len(cfg.Regions)+1) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-errC; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	// A reloaded GslbCore can serve on the same address right away.
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("HTTP server address is still in use after Run returned: %v", err)
+	}
+	ln.Close()
 }
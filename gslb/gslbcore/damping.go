@@ -0,0 +1,70 @@
+package gslbcore
+
+import (
+	"time"
+)
+
+// flapDamper holds down a PoP turning between healthy and erroring too
+// often, so that its clients aren't bounced back and forth between PoPs.
+type flapDamper struct {
+	threshold int
+	window    time.Duration
+	holdDown  time.Duration
+
+	observed bool
+	healthy  bool
+	// The times the PoP turned healthy or erroring within the window.
+	turns         []time.Time
+	holdDownUntil time.Time
+}
+
+// observe records the health of the PoP at now, and returns whether it is
+// held down.
+func (d *flapDamper) observe(healthy bool, now time.Time) bool {
+	if d.observed && healthy != d.healthy {
+		d.turns = append(d.turns, now)
+	}
+	d.observed = true
+	d.healthy = healthy
+
+	for len(d.turns) > 0 && now.Sub(d.turns[0]) > d.window {
+		d.turns = d.turns[1:]
+	}
+	if len(d.turns) >= d.threshold {
+		d.holdDownUntil = d.turns[len(d.turns)-1].Add(d.holdDown)
+	}
+	return now.Before(d.holdDownUntil)
+}
+
+// updatePreferredLocked settles the region on the healthy PoP of the lowest
+// latency. Once settled, the region only moves to another PoP after it has
+// been better by cfg.SwitchMargin for cfg.SwitchRounds consecutive rounds,
+// or right away if the current PoP turns unhealthy or unknown.
+func (c *GslbCore) updatePreferredLocked(r *RegionState, healthy []bool) {
+	best := -1
+	for i, lat := range r.popLatency {
+		if healthy[i] && lat.Known && (best == -1 || lat.Value < r.popLatency[best].Value) {
+			best = i
+		}
+	}
+
+	cur := r.preferred
+	switch {
+	case best == -1:
+		r.preferred = -1
+	case cur == -1 || !healthy[cur] || !r.popLatency[cur].Known:
+		r.preferred = best
+	case best != cur && r.popLatency[best].Value < r.popLatency[cur].Value*(1-c.switchMargin):
+		if best != r.challenger {
+			r.challenger = best
+			r.streak = 0
+		}
+		r.streak++
+		if r.streak < c.switchRounds {
+			return
+		}
+		r.preferred = best
+	}
+	r.challenger = -1
+	r.streak = 0
+}
@@ -0,0 +1,154 @@
+package gslbcore_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+	"github.com/yzp0n/ncdn/types"
+)
+
+// dampingTestCore is a GslbCore of shinjuku and shibuya seen from us-west,
+// whose latency and health are set by the test before each round.
+type dampingTestCore struct {
+	*gslbcore.GslbCore
+
+	latency  map[string]float64 // pop id -> latency
+	down     map[string]bool    // pop id -> down
+	popOfURL map[string]string  // latency endpoint url -> pop id
+}
+
+func newDampingTestCore(modify func(cfg *gslbcore.Config)) *dampingTestCore {
+	d := &dampingTestCore{
+		latency:  make(map[string]float64),
+		down:     make(map[string]bool),
+		popOfURL: make(map[string]string),
+	}
+
+	cfg := newTestConfig()
+	cfg.Pops = cfg.Pops[:2]
+	cfg.Regions = cfg.Regions[:1]
+	cfg.Policy = gslbcore.NearestPolicy{}
+	cfg.LatencySamples = 1
+	cfg.LatencyAlpha = 1
+	popOfIP := make(map[netip.Addr]string)
+	for _, p := range cfg.Pops {
+		popOfIP[p.Ip4] = p.Id
+		d.popOfURL[p.LatencyEndpointUrl] = p.Id
+	}
+	cfg.FetchPoPStatus = func(ctx context.Context, ip netip.Addr) (*types.PoPStatus, error) {
+		if d.down[popOfIP[ip]] {
+			return nil, errors.New("PoP is down.")
+		}
+		return &types.PoPStatus{Id: popOfIP[ip]}, nil
+	}
+	cfg.MakeLatencyMeasurer = func(region types.RegionInfo, secret string) gslbcore.LatencyMeasurer {
+		return d
+	}
+	if modify != nil {
+		modify(cfg)
+	}
+
+	d.GslbCore = gslbcore.New(cfg)
+	return d
+}
+
+func (d *dampingTestCore) DebugString() string { return "dampingTestCore" }
+
+func (d *dampingTestCore) MeasureLatency(ctx context.Context, url string) (float64, error) {
+	lat, ok := d.latency[d.popOfURL[url]]
+	if !ok {
+		return 0, fmt.Errorf("no latency for %s", url)
+	}
+	return lat, nil
+}
+
+// round runs a round of measurements, and returns the PoP answered to a
+// us-west client.
+func (d *dampingTestCore) round(t *testing.T) string {
+	t.Helper()
+
+	d.UpdatePoPStatus(context.Background())
+	d.UpdateLatency(context.Background())
+
+	rs := d.Query("www", netip.MustParseAddr("198.51.100.12"), gslbcore.IPv4)
+	if len(rs) != 1 {
+		t.Fatalf("Query: got %v, want 1 answer", rs)
+	}
+	return d.PopIdFromIP(rs[0])
+}
+
+func TestHysteresis(t *testing.T) {
+	d := newDampingTestCore(func(cfg *gslbcore.Config) {
+		cfg.SwitchMargin = 0.1
+		cfg.SwitchRounds = 2
+	})
+
+	steps := []struct {
+		Name     string
+		Shinjuku float64
+		Shibuya  float64
+		Down     string
+		Want     string
+	}{
+		{"initial", 50, 60, "", "shinjuku"},
+		{"within-margin", 50, 47, "", "shinjuku"},
+		{"better-once", 50, 40, "", "shinjuku"},
+		{"streak-broken", 50, 50, "", "shinjuku"},
+		{"better-again", 50, 40, "", "shinjuku"},
+		{"better-twice", 50, 40, "", "shibuya"},
+		{"shinjuku-better-once", 30, 40, "", "shibuya"},
+		{"failover", 30, 40, "shibuya", "shinjuku"},
+	}
+	for _, s := range steps {
+		d.latency["shinjuku"] = s.Shinjuku
+		d.latency["shibuya"] = s.Shibuya
+		d.down = map[string]bool{s.Down: true}
+
+		if got := d.round(t); got != s.Want {
+			t.Errorf("%s: got %s, want %s", s.Name, got, s.Want)
+		}
+	}
+}
+
+func TestFlapDamping(t *testing.T) {
+	clock := newTestClock()
+	d := newDampingTestCore(func(cfg *gslbcore.Config) {
+		cfg.Now = clock.Now
+		cfg.FlapThreshold = 3
+		cfg.FlapWindow = time.Hour
+		cfg.FlapHoldDown = 5 * time.Minute
+		// Follow the lower latency right away.
+		cfg.SwitchRounds = 1
+	})
+	d.latency["shinjuku"] = 50
+	d.latency["shibuya"] = 10
+
+	steps := []struct {
+		ShibuyaDown bool
+		Want        string
+	}{
+		{false, "shibuya"},
+		{true, "shinjuku"},
+		{false, "shibuya"},
+		{true, "shinjuku"},
+		// The 3rd turn: held down.
+		{false, "shinjuku"},
+		{false, "shinjuku"},
+	}
+	for i, s := range steps {
+		d.down["shibuya"] = s.ShibuyaDown
+		if got := d.round(t); got != s.Want {
+			t.Errorf("round %d: got %s, want %s", i, got, s.Want)
+		}
+	}
+
+	clock.Advance(5 * time.Minute)
+	if got := d.round(t); got != "shibuya" {
+		t.Errorf("after the hold down: got %s, want shibuya", got)
+	}
+}
@@ -0,0 +1,172 @@
+package gslbcore
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// Explanation tells how a query was answered.
+type Explanation struct {
+	Service string     `json:"service"`
+	SrcIP   netip.Addr `json:"src_ip"`
+	Family  Family     `json:"family"`
+
+	// The region the client matched and the prefix it matched by, if any.
+	Region string `json:"region,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+
+	Policy    string `json:"policy"`
+	Preferred string `json:"preferred,omitempty"`
+
+	// Whether no PoP of the pool was healthy, so that the unhealthy ones
+	// were answerable.
+	FailOpen bool `json:"fail_open,omitempty"`
+
+	// All PoPs, the answered ones first, then the rest of the policy's
+	// selection.
+	Candidates []Candidate `json:"candidates"`
+
+	Answers []AnnotatedLookup `json:"answers"`
+}
+
+// Candidate is a PoP as considered by a query.
+type Candidate struct {
+	PopId string     `json:"pop_id"`
+	Addr  netip.Addr `json:"addr,omitzero"`
+
+	// The latency the PoPs were ranked by. For clients not in any region,
+	// it is averaged over the regions, and the default PoP is ranked first
+	// instead.
+	Latency    Latency `json:"latency"`
+	DefaultPop bool    `json:"default_pop,omitempty"`
+
+	Load        float64 `json:"load"`
+	Utilization float64 `json:"utilization"`
+
+	// Why the PoP is unhealthy, if it is.
+	Error            string    `json:"error,omitempty"`
+	HealthCheckError string    `json:"health_check_error,omitempty"`
+	Override         *Override `json:"override,omitempty"`
+	Healthy          bool      `json:"healthy"`
+
+	// The position in the selection of the policy, starting at 1, after the
+	// weighted-down PoPs are demoted. Zero if not selected.
+	Rank     int  `json:"rank,omitempty"`
+	Answered bool `json:"answered"`
+
+	// The rule the PoP was eliminated by, unless answered.
+	Eliminated string `json:"eliminated,omitempty"`
+}
+
+// Explain answers srcIP for the service like Query, and tells how.
+func (c *GslbCore) Explain(service string, srcIP netip.Addr, family Family) (*Explanation, error) {
+	d := c.decide(service, srcIP, family)
+	if d == nil {
+		return nil, fmt.Errorf("Unknown service %q", service)
+	}
+	s := d.snapshot
+
+	e := &Explanation{
+		Service:   d.svc.info.Name,
+		SrcIP:     srcIP,
+		Family:    family,
+		Policy:    d.svc.policy.Name(),
+		Preferred: s.Preferred,
+		FailOpen:  d.failOpen,
+	}
+	if s.Region != nil {
+		e.Region = s.Region.Id
+		e.Prefix = d.prefix.String()
+	}
+
+	now := c.now()
+	for i, pop := range c.cfg.Pops {
+		cand := Candidate{
+			PopId:            pop.Id,
+			Addr:             family.Addr(pop),
+			Latency:          s.Latency[i],
+			Load:             s.PoPStatus[i].Load,
+			Utilization:      s.Utilization(i),
+			Error:            s.PoPStatus[i].Error,
+			HealthCheckError: d.checkErr[i],
+			Healthy:          s.Healthy[i],
+			Rank:             slices.Index(d.selected, i) + 1,
+			Answered:         slices.Contains(d.answers, i),
+		}
+		if s.Region == nil && pop.Id == s.Preferred {
+			cand.DefaultPop = true
+		}
+		if o := d.overrides[i]; o.activeAt(now) {
+			cand.Override = &o
+		}
+		if !cand.Answered {
+			cand.Eliminated = d.eliminatedBy(i, srcIP, now)
+		}
+		e.Candidates = append(e.Candidates, cand)
+	}
+	slices.SortStableFunc(e.Candidates, func(a, b Candidate) int {
+		return cmp.Or(
+			-cmp.Compare(boolInt(a.Answered), boolInt(b.Answered)),
+			cmp.Compare(rankKey(a.Rank), rankKey(b.Rank)))
+	})
+
+	for _, i := range d.answers {
+		pop := c.cfg.Pops[i]
+		e.Answers = append(e.Answers, AnnotatedLookup{Ip: family.Addr(pop), PopId: pop.Id})
+	}
+	return e, nil
+}
+
+// eliminatedBy returns the rule the i-th PoP wasn't answered by.
+func (d *decision) eliminatedBy(i int, srcIP netip.Addr, now time.Time) string {
+	pop := d.snapshot.Pops[i]
+	o := d.overrides[i]
+	overridden := o.activeAt(now)
+
+	switch {
+	case !d.svc.inPool[i]:
+		return fmt.Sprintf("not in the pool of service %q", d.svc.info.Name)
+	case !d.family.Has(pop):
+		return fmt.Sprintf("no IPv%d address", d.family)
+	case overridden && o.Mode == OverrideDisable:
+		return "disabled by the operator"
+	case !d.snapshot.Healthy[i]:
+		switch {
+		case overridden && o.Mode == OverrideDrain:
+			return "drained by the operator"
+		case d.snapshot.PoPStatus[i].Error != "":
+			return "unhealthy: " + d.snapshot.PoPStatus[i].Error
+		default:
+			return "failed the health check: " + d.checkErr[i]
+		}
+	}
+
+	rank := slices.Index(d.selected, i)
+	switch {
+	case rank == -1:
+		return fmt.Sprintf("not selected by the %s policy", d.svc.policy.Name())
+	case !keepsClient(srcIP, pop.Id, d.weights[i]):
+		return fmt.Sprintf("weighted down to %v by the operator", d.weights[i])
+	default:
+		return fmt.Sprintf("ranked %d, beyond the %d answers", rank+1, d.svc.answers)
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// rankKey orders the unselected PoPs, of rank 0, last.
+func rankKey(rank int) int {
+	if rank == 0 {
+		return math.MaxInt
+	}
+	return rank
+}
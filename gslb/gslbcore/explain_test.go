@@ -0,0 +1,101 @@
+package gslbcore_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+)
+
+func TestExplain(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.DefaultPop = "akiba"
+	cfg.Services = []gslbcore.Service{
+		{Name: "www", PopIds: []string{"shibuya", "akiba", "atlantis"}},
+	}
+	c := startTestCore(t, cfg)
+
+	explain := func(srcIP string) map[string]gslbcore.Candidate {
+		t.Helper()
+		e, err := c.Explain("www", netip.MustParseAddr(srcIP), gslbcore.IPv4)
+		if err != nil {
+			t.Fatalf("Explain: %v", err)
+		}
+		if _, err := json.Marshal(e); err != nil {
+			t.Fatalf("json.Marshal(%+v): %v", e, err)
+		}
+		if e.Candidates[0].PopId != e.Answers[0].PopId {
+			t.Errorf("the answered PoP %s isn't the first candidate: %+v", e.Answers[0].PopId, e.Candidates)
+		}
+		m := make(map[string]gslbcore.Candidate)
+		for _, cand := range e.Candidates {
+			m[cand.PopId] = cand
+		}
+		return m
+	}
+	check := func(name string, got map[string]gslbcore.Candidate, want map[string]string) {
+		t.Helper()
+		for popId, eliminated := range want {
+			if got[popId].Eliminated != eliminated {
+				t.Errorf("%s: %s eliminated by %q, want %q", name, popId, got[popId].Eliminated, eliminated)
+			}
+		}
+	}
+
+	// us-west: shibuya (50ms), akiba (80ms), shinjuku (100ms). atlantis is down.
+	got := explain("198.51.100.12")
+	check("us-west", got, map[string]string{
+		"shibuya":  "",
+		"akiba":    "ranked 2, beyond the 1 answers",
+		"shinjuku": `not in the pool of service "www"`,
+		"atlantis": "unhealthy: PoP is down.",
+	})
+	if cand := got["shibuya"]; !cand.Answered || cand.Rank != 1 || !cand.Latency.Known || cand.Latency.Value != 50 || cand.Load != 2 {
+		t.Errorf("shibuya: got %+v", cand)
+	}
+
+	if err := c.SetOverride("akiba", gslbcore.Override{Mode: gslbcore.OverrideDrain}); err != nil {
+		t.Fatal(err)
+	}
+	check("akiba drained", explain("198.51.100.12"), map[string]string{
+		"akiba": "drained by the operator",
+	})
+	if err := c.ClearOverride("akiba"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not in any region, so the default PoP is answered.
+	got = explain("203.0.113.1")
+	if cand := got["akiba"]; !cand.Answered || !cand.DefaultPop {
+		t.Errorf("akiba: got %+v, want the answered default PoP", cand)
+	}
+	check("no region", got, map[string]string{
+		"shibuya": "ranked 2, beyond the 1 answers",
+	})
+
+	if _, err := c.Explain("cdn", netip.MustParseAddr("198.51.100.12"), gslbcore.IPv4); err == nil {
+		t.Errorf("Explain of an unknown service: expected an error")
+	}
+
+	rec := httptest.NewRecorder()
+	gslbcore.HTTPHandler(c).ServeHTTP(rec, httptest.NewRequest("GET", "/query?srcip=198.51.100.12&explain=1", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"region":"us-west","prefix":"198.51.100.0/28"`) {
+		t.Errorf("GET /query?explain=1: got %d %s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	gslbcore.HTTPHandler(c).ServeHTTP(rec, httptest.NewRequest("GET", "/query?srcip=198.51.100.12&explain=false", nil))
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `"region"`) {
+		t.Errorf("GET /query?explain=false: got %d %s, want the answers alone", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	gslbcore.HTTPHandler(c).ServeHTTP(rec, httptest.NewRequest("GET", "/query?srcip=198.51.100.12&explain=maybe", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("GET /query?explain=maybe: got %d, want 400", rec.Code)
+	}
+}
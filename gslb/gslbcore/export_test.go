@@ -0,0 +1,17 @@
+package gslbcore
+
+import (
+	"net/netip"
+
+	"github.com/yzp0n/ncdn/types"
+)
+
+// CompileRegions exposes the region lookup of GslbCore to tests.
+func CompileRegions(regions []types.RegionInfo) func(ip netip.Addr) (int, netip.Prefix) {
+	return newRegionTrie(regions).lookup
+}
+
+var AggregateSamples = aggregateSamples
+
+// HTTPHandler exposes the handler of Config.HTTPServer to tests.
+var HTTPHandler = (*GslbCore).httpHandler
@@ -14,7 +14,7 @@ import (
 )
 
 func FetchPoPStatusOverHTTP(ctx context.Context, ip netip.Addr) (*types.PoPStatus, error) {
-	req, err := http.NewRequest(http.MethodGet, "http://"+ip.String()+":8889/statusz", nil)
+	req, err := http.NewRequest(http.MethodGet, "http://"+netip.AddrPortFrom(ip, 8889).String()+"/statusz", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -41,13 +41,45 @@ func FetchPoPStatusOverHTTP(ctx context.Context, ip netip.Addr) (*types.PoPStatu
 	return &ps, nil
 }
 
+// CheckHealthOverHTTP fetches the url, and fails unless it responds with a
+// 2xx status.
+func CheckHealthOverHTTP(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Health check responded with status %s", resp.Status)
+	}
+	return nil
+}
+
 type ProbeOverJSONRPC struct {
 	ProberURL string
 	Secret    string
+
+	// The phase of the probe taken as the latency. Defaults to
+	// PhaseFirstByte.
+	Phase ProbePhase
 }
 
 func (p ProbeOverJSONRPC) DebugString() string {
-	return fmt.Sprintf("ProbeOverJSONRPC{ProberURL=%s}", p.ProberURL)
+	return fmt.Sprintf("ProbeOverJSONRPC{ProberURL=%s, Phase=%s}", p.ProberURL, p.phase())
+}
+
+func (p ProbeOverJSONRPC) phase() ProbePhase {
+	if p.Phase == (ProbePhase{}) {
+		return PhaseFirstByte
+	}
+	return p.Phase
 }
 
 func (p ProbeOverJSONRPC) MeasureLatency(ctx context.Context, url string) (float64, error) {
@@ -86,5 +118,5 @@ func (p ProbeOverJSONRPC) MeasureLatency(ctx context.Context, url string) (float
 		return 0, fmt.Errorf("Failed to unmarshal ProbeResult: %v", err)
 	}
 
-	return float64(res.FirstByte-res.Start) / 1e6, nil
+	return p.phase().Measure(&res)
 }
@@ -2,13 +2,19 @@ package gslbcore
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 	"net/netip"
-	"slices"
+	"strconv"
+	"sync"
 	"time"
+
+	"github.com/yzp0n/ncdn/types"
 )
 
 type AnnotatedLookup struct {
@@ -16,7 +22,16 @@ type AnnotatedLookup struct {
 	PopId string     `json:"pop_id"`
 }
 
-func (c *GslbCore) spawnHTTPServer(ctx context.Context) error {
+// overrideRequest is the body of PUT /admin/pops/{id}/override.
+type overrideRequest struct {
+	Override
+
+	// Alternative to Expires relative to now, e.g. "30m".
+	ExpiresIn string `json:"expires_in,omitempty"`
+}
+
+// httpHandler serves the web UI, its JSON APIs, and the admin API.
+func (c *GslbCore) httpHandler() http.Handler {
 	mux := http.NewServeMux()
 
 	fs := http.FileServer(http.Dir("./gslb/gslbcore/static"))
@@ -62,8 +77,51 @@ func (c *GslbCore) spawnHTTPServer(ctx context.Context) error {
 			srcIP = parsed
 		}
 
+		service := cmp.Or(r.URL.Query().Get("service"), c.services[0].info.Name)
+		if c.service(service) == nil {
+			http.Error(w, "Unknown service", http.StatusNotFound)
+			return
+		}
+
+		family := IPv4
+		switch r.URL.Query().Get("family") {
+		case "", "4":
+		case "6":
+			family = IPv6
+		default:
+			http.Error(w, "family must be 4 or 6", http.StatusBadRequest)
+			return
+		}
+
+		explain := false
+		if s := r.URL.Query().Get("explain"); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				http.Error(w, "Invalid explain", http.StatusBadRequest)
+				return
+			}
+			explain = b
+		}
+
+		if explain {
+			e, err := c.Explain(service, srcIP, family)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			bs, err := json.Marshal(e)
+			if err != nil {
+				http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(bs)
+			return
+		}
+
 		slog.Info("Query via HTTP start", slog.String("srcip", srcIP.String()))
-		results := c.Query(srcIP)
+		results := c.Query(service, srcIP, family)
 		slog.Info("Query via HTTP end")
 		alus := make([]AnnotatedLookup, len(results))
 		for i := range results {
@@ -97,7 +155,7 @@ func (c *GslbCore) spawnHTTPServer(ctx context.Context) error {
 			return
 		}
 
-		latencyMap := make(map[string]float64)
+		latencyMap := make(map[string]Latency)
 		c.mu.Lock()
 		for i, r := range c.regions {
 			latencyMap[c.cfg.Regions[i].Id] = r.popLatency[popIdx]
@@ -116,17 +174,13 @@ func (c *GslbCore) spawnHTTPServer(ctx context.Context) error {
 	mux.HandleFunc("/latency_to_region", func(w http.ResponseWriter, r *http.Request) {
 		regionId := r.URL.Query().Get("region_id")
 
-		var popLatency []float64
-		c.mu.Lock()
-		for _, r := range c.regions {
-			if r.info.Id == regionId {
-				popLatency = slices.Clone(r.popLatency)
-				break
-			}
+		popLatency, ok := c.RegionLatency(regionId)
+		if !ok {
+			http.Error(w, "Invalid region_id", http.StatusBadRequest)
+			return
 		}
-		c.mu.Unlock()
 
-		latencyMap := make(map[string]float64)
+		latencyMap := make(map[string]Latency)
 		for i, pop := range c.cfg.Pops {
 			latencyMap[pop.Id] = popLatency[i]
 		}
@@ -141,14 +195,135 @@ func (c *GslbCore) spawnHTTPServer(ctx context.Context) error {
 		_, _ = w.Write(bs)
 	})
 
+	mux.HandleFunc("/overrides.json", func(w http.ResponseWriter, r *http.Request) {
+		bs, err := json.Marshal(c.Overrides())
+		if err != nil {
+			http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bs)
+	})
+	mux.HandleFunc("/querylog.json", func(w http.ResponseWriter, r *http.Request) {
+		limit := 100
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		bs, err := json.Marshal(c.RecentQueries(limit))
+		if err != nil {
+			http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bs)
+	})
+	mux.HandleFunc("/querystats.json", func(w http.ResponseWriter, r *http.Request) {
+		bs, err := json.Marshal(c.QueryStats())
+		if err != nil {
+			http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bs)
+	})
+
+	// Beacons are sent by the pages of the PoPs as simple requests, whose
+	// responses the pages don't read, so that no CORS headers are needed.
+	mux.HandleFunc("POST /rum", func(w http.ResponseWriter, r *http.Request) {
+		var b types.RUMBeacon
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&b); err != nil {
+			http.Error(w, "Failed to parse JSON data", http.StatusBadRequest)
+			return
+		}
+		var remoteIP netip.Addr
+		if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+			remoteIP = addrPort.Addr()
+		}
+
+		if err := c.ReportRUM(&b, remoteIP); err != nil {
+			code := http.StatusBadRequest
+			switch {
+			case errors.Is(err, errRUMDisabled):
+				code = http.StatusNotFound
+			case errors.Is(err, errRUMRateLimited):
+				code = http.StatusTooManyRequests
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("PUT /admin/pops/{id}/override", c.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		var req overrideRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Failed to parse JSON data", http.StatusBadRequest)
+			return
+		}
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil || d <= 0 {
+				http.Error(w, "Failed to parse expires_in", http.StatusBadRequest)
+				return
+			}
+			req.Expires = c.now().Add(d)
+		}
+
+		if err := c.SetOverride(r.PathValue("id"), req.Override); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("DELETE /admin/pops/{id}/override", c.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if err := c.ClearOverride(r.PathValue("id")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fs.ServeHTTP(w, r)
 	})
+	return mux
+}
+
+// requireAdmin wraps h to require Config.AdminSecret as the bearer token.
+// The admin API is disabled unless the secret is configured.
+func (c *GslbCore) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.cfg.AdminSecret == "" {
+			http.Error(w, "Admin API is disabled", http.StatusForbidden)
+			return
+		}
+		want := "Bearer " + c.cfg.AdminSecret
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
 
+// spawnHTTPServer serves httpHandler until ctx is done. The shutdown is
+// tracked by wg.
+func (c *GslbCore) spawnHTTPServer(ctx context.Context, wg *sync.WaitGroup) error {
 	laddr := c.cfg.HTTPServer
 	srv := &http.Server{
 		Addr:    laddr,
-		Handler: mux,
+		Handler: c.httpHandler(),
 	}
 	errC := make(chan error)
 	go func() {
@@ -157,19 +332,22 @@ func (c *GslbCore) spawnHTTPServer(ctx context.Context) error {
 		}
 		close(errC)
 	}()
-	go func() {
-		<-ctx.Done()
-		err := srv.Shutdown(ctx)
-		if err != nil {
-			slog.Error("HTTP server shutdown failed", slog.String("error", err.Error()))
-		}
-	}()
 
 	select {
 	case err := <-errC:
 		return err
 	case <-time.After(time.Second):
 		slog.Info("HTTP server is running without error for 1 sec.", slog.String("addr", laddr))
-		return nil
 	}
+
+	wg.Go(func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := srv.Shutdown(shutdownCtx)
+		if err != nil {
+			slog.Error("HTTP server shutdown failed", slog.String("error", err.Error()))
+		}
+	})
+	return nil
 }
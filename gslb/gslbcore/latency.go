@@ -0,0 +1,97 @@
+package gslbcore
+
+import (
+	"cmp"
+	"encoding/json"
+	"math"
+	"slices"
+)
+
+// Latency is the estimated latency to a PoP in milliseconds. It isn't Known
+// until a measurement succeeds, and becomes unknown again once measurements
+// keep failing.
+type Latency struct {
+	Value float64
+	Known bool
+}
+
+// Compare orders latencies ascending, with unknown ones last.
+func (l Latency) Compare(o Latency) int {
+	if l.Known != o.Known {
+		if l.Known {
+			return -1
+		}
+		return 1
+	}
+	return cmp.Compare(l.Value, o.Value)
+}
+
+// MarshalJSON encodes an unknown latency as null.
+func (l Latency) MarshalJSON() ([]byte, error) {
+	if !l.Known {
+		return []byte("null"), nil
+	}
+	return json.Marshal(l.Value)
+}
+
+// UnmarshalJSON decodes null as an unknown latency.
+func (l *Latency) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*l = Latency{}
+		return nil
+	}
+	*l = Latency{Known: true}
+	return json.Unmarshal(b, &l.Value)
+}
+
+// aggregateSamples combines the samples of a measurement round. Outliers
+// are rejected by taking the median, or if trim is non-zero, the mean after
+// discarding the fraction `trim` of the samples from each end.
+func aggregateSamples(samples []float64, trim float64) float64 {
+	sorted := slices.Sorted(slices.Values(samples))
+	n := len(sorted)
+
+	if trim <= 0 || trim >= 0.5 {
+		if n%2 == 1 {
+			return sorted[n/2]
+		}
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+
+	k := int(math.Floor(float64(n) * trim))
+	kept := sorted[k : n-k]
+	sum := 0.0
+	for _, s := range kept {
+		sum += s
+	}
+	return sum / float64(len(kept))
+}
+
+// latencyEstimator smooths the latency to a PoP over rounds.
+type latencyEstimator struct {
+	alpha       float64
+	maxFailures int
+
+	estimate Latency
+	failures int
+}
+
+// update folds a round into the estimate. samples is empty if no
+// measurement of the round succeeded.
+func (e *latencyEstimator) update(samples []float64, trim float64) Latency {
+	if len(samples) == 0 {
+		e.failures++
+		if e.failures >= e.maxFailures {
+			e.estimate = Latency{}
+		}
+		return e.estimate
+	}
+	e.failures = 0
+
+	lat := aggregateSamples(samples, trim)
+	if e.estimate.Known {
+		lat = e.alpha*lat + (1-e.alpha)*e.estimate.Value
+	}
+	e.estimate = Latency{Value: lat, Known: true}
+	return e.estimate
+}
@@ -0,0 +1,97 @@
+package gslbcore_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+	"github.com/yzp0n/ncdn/types"
+)
+
+func TestAggregateSamples(t *testing.T) {
+	testcases := []struct {
+		Samples []float64
+		Trim    float64
+		Want    float64
+	}{
+		{[]float64{10, 900, 12}, 0, 12},
+		{[]float64{10, 900, 12, 14}, 0, 13},
+		{[]float64{42}, 0, 42},
+		{[]float64{10, 900, 12, 14, 1}, 0.2, 12},
+		{[]float64{10, 12, 14}, 0.2, 12},
+		{[]float64{10, 900, 12, 14}, 0.5, 13},
+	}
+	for _, tc := range testcases {
+		if got := gslbcore.AggregateSamples(tc.Samples, tc.Trim); math.Abs(got-tc.Want) > 1e-9 {
+			t.Errorf("AggregateSamples(%v, %v): got %v, want %v", tc.Samples, tc.Trim, got, tc.Want)
+		}
+	}
+}
+
+// scriptedLatencyMeasurer returns the samples of rounds[round] in order.
+// A NaN sample fails.
+type scriptedLatencyMeasurer struct {
+	rounds [][]float64
+	round  int
+	n      int
+}
+
+func (m *scriptedLatencyMeasurer) DebugString() string {
+	return "scriptedLatencyMeasurer"
+}
+
+func (m *scriptedLatencyMeasurer) MeasureLatency(ctx context.Context, url string) (float64, error) {
+	samples := m.rounds[m.round]
+	lat := samples[m.n%len(samples)]
+	m.n++
+	if math.IsNaN(lat) {
+		return 0, errors.New("probe failed")
+	}
+	return lat, nil
+}
+
+func TestUpdateLatency(t *testing.T) {
+	nan := math.NaN()
+	m := &scriptedLatencyMeasurer{
+		rounds: [][]float64{
+			{nan},
+			{20, 500, 22},
+			{30, nan, 30},
+			{nan},
+			{nan},
+			{40},
+		},
+	}
+
+	cfg := newTestConfig()
+	cfg.Pops = cfg.Pops[:1]
+	cfg.Regions = cfg.Regions[:1]
+	cfg.LatencyAlpha = 0.5
+	cfg.LatencyMaxFailures = 2
+	cfg.MakeLatencyMeasurer = func(region types.RegionInfo, secret string) gslbcore.LatencyMeasurer { return m }
+	c := gslbcore.New(cfg)
+
+	want := []gslbcore.Latency{
+		{},
+		{Value: 22, Known: true},
+		{Value: 26, Known: true}, // 0.5*30 + 0.5*22
+		{Value: 26, Known: true},
+		{},
+		{Value: 40, Known: true},
+	}
+	for round, w := range want {
+		m.round, m.n = round, 0
+		c.UpdateLatency(context.Background())
+
+		lat, ok := c.RegionLatency("us-west")
+		if !ok {
+			t.Fatalf("RegionLatency: region not found")
+		}
+		if fmt.Sprint(lat[0]) != fmt.Sprint(w) {
+			t.Errorf("round %d: got %+v, want %+v", round, lat[0], w)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package gslbcore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// A reader of MaxMind DB files, just enough to list the networks of a
+// database. See https://maxmind.github.io/MaxMind-DB/ for the format.
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errMMDBCorrupt = errors.New("MMDB file is corrupt")
+
+type mmdbReader struct {
+	tree       []byte
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+	data       mmdbDecoder
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i == -1 {
+		return nil, fmt.Errorf("Failed to find the MMDB metadata in %s", path)
+	}
+	v, _, err := mmdbDecoder{buf: buf[i+len(mmdbMetadataMarker):]}.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode the MMDB metadata in %s: %v", path, err)
+	}
+	md, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected MMDB metadata in %s", path)
+	}
+
+	r := &mmdbReader{}
+	for _, f := range []struct {
+		key string
+		ptr *uint64
+	}{
+		{"node_count", &r.nodeCount},
+		{"record_size", &r.recordSize},
+		{"ip_version", &r.ipVersion},
+	} {
+		n, ok := md[f.key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("MMDB metadata in %s lacks %s", path, f.key)
+		}
+		*f.ptr = n
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("Unsupported MMDB record size %d in %s", r.recordSize, path)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("Unsupported MMDB ip version %d in %s", r.ipVersion, path)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint64(i) {
+		return nil, errMMDBCorrupt
+	}
+	r.tree = buf[:treeSize]
+	r.data = mmdbDecoder{buf: buf[treeSize+16 : i]}
+	return r, nil
+}
+
+// record returns the left (bit=0) or right (bit=1) record of the node.
+func (r *mmdbReader) record(node uint64, bit int) uint64 {
+	switch r.recordSize {
+	case 24:
+		b := r.tree[node*6:]
+		if bit == 1 {
+			b = b[3:]
+		}
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+
+	default:
+		b := r.tree[node*8:]
+		return uint64(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// networks returns the networks whose data satisfies match. IPv4 networks
+// of an IPv6 database are returned as IPv4 prefixes, and the aliases of the
+// IPv4 subtree (e.g. ::ffff:0:0/96) are skipped.
+func (r *mmdbReader) networks(match func(record any) bool) ([]netip.Prefix, error) {
+	bitLen := 32
+	ipv4Start := uint64(math.MaxUint64)
+	if r.ipVersion == 6 {
+		bitLen = 128
+		node := uint64(0)
+		for range 96 {
+			if node >= r.nodeCount {
+				break
+			}
+			node = r.record(node, 0)
+		}
+		ipv4Start = node
+	}
+
+	type entry struct {
+		node  uint64
+		key   uint128
+		depth int
+	}
+	stack := []entry{{node: 0}}
+	matched := make(map[uint64]bool)
+
+	var ret []netip.Prefix
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		for bit := range 2 {
+			key := e.key
+			if bit == 1 {
+				key = key.setBit(e.depth)
+			}
+			depth := e.depth + 1
+
+			rec := r.record(e.node, bit)
+			switch {
+			case rec < r.nodeCount:
+				if rec == ipv4Start && !(depth == 96 && key == (uint128{})) {
+					continue
+				}
+				if depth >= bitLen {
+					return nil, errMMDBCorrupt
+				}
+				stack = append(stack, entry{node: rec, key: key, depth: depth})
+
+			case rec == r.nodeCount:
+				// no data
+
+			default:
+				off := rec - r.nodeCount - 16
+				ok, seen := matched[off]
+				if !seen {
+					v, _, err := r.data.decode(int(off))
+					if err != nil {
+						return nil, err
+					}
+					ok = match(v)
+					matched[off] = ok
+				}
+				if ok {
+					ret = append(ret, r.prefix(key, depth))
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (r *mmdbReader) prefix(key uint128, depth int) netip.Prefix {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], key.hi)
+	binary.BigEndian.PutUint64(b[8:], key.lo)
+
+	if r.ipVersion == 4 {
+		return netip.PrefixFrom(netip.AddrFrom4([4]byte(b[:4])), depth)
+	}
+	if depth >= 96 && key.hi == 0 && key.lo>>32 == 0 {
+		return netip.PrefixFrom(netip.AddrFrom4([4]byte(b[12:])), depth-96)
+	}
+	return netip.PrefixFrom(netip.AddrFrom16(b), depth)
+}
+
+// mmdbDecoder decodes values of the MMDB data section format.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+func (d mmdbDecoder) bytes(off, n int) ([]byte, error) {
+	if off < 0 || n < 0 || off+n > len(d.buf) {
+		return nil, errMMDBCorrupt
+	}
+	return d.buf[off : off+n], nil
+}
+
+func beUint(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+// decode returns the value at off, and the offset following it.
+func (d mmdbDecoder) decode(off int) (any, int, error) {
+	b, err := d.bytes(off, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	off++
+
+	typ := int(ctrl >> 5)
+	if typ == 1 {
+		ss := int(ctrl>>3) & 3
+		b, err := d.bytes(off, ss+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		vvv := uint64(ctrl & 7)
+		var p uint64
+		switch ss {
+		case 0:
+			p = vvv<<8 | beUint(b)
+		case 1:
+			p = vvv<<16 | beUint(b) + 2048
+		case 2:
+			p = vvv<<24 | beUint(b) + 526336
+		default:
+			p = beUint(b)
+		}
+
+		// A pointer to a pointer is invalid.
+		if t, err := d.bytes(int(p), 1); err != nil || t[0]>>5 == 1 {
+			return nil, 0, errMMDBCorrupt
+		}
+		v, _, err := d.decode(int(p))
+		return v, off + ss + 1, err
+	}
+	if typ == 0 {
+		b, err := d.bytes(off, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + int(b[0])
+		off++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(off, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		size = []int{29, 285, 65821}[n-1] + int(beUint(b))
+		off += n
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]any, size)
+		for range size {
+			k, next, err := d.decode(off)
+			if err != nil {
+				return nil, 0, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			v, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[ks] = v
+			off = next
+		}
+		return m, off, nil
+
+	case 11: // array
+		a := make([]any, 0, size)
+		for range size {
+			v, next, err := d.decode(off)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+
+	case 14: // boolean
+		return size != 0, off, nil
+	}
+
+	b, err = d.bytes(off, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	off += size
+
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), off, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case 4, 10: // bytes, uint128
+		return bytes.Clone(b), off, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		if size > 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return beUint(b), off, nil
+	case 8: // int32
+		if size > 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		shift := 32 - 8*size
+		return int64(int32(uint32(beUint(b))<<shift) >> shift), off, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	default:
+		return nil, 0, fmt.Errorf("Unsupported MMDB data type %d", typ)
+	}
+}
@@ -0,0 +1,159 @@
+package gslbcore
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/yzp0n/ncdn/types"
+)
+
+// OverrideMode is how an operator takes a PoP out of the GSLB's hands.
+type OverrideMode string
+
+const (
+	// A drained PoP is treated as unhealthy: it is only answered if no
+	// other PoP of the pool can be.
+	OverrideDrain OverrideMode = "drain"
+
+	// A disabled PoP is never answered.
+	OverrideDisable OverrideMode = "disable"
+
+	// A weighted-down PoP keeps only the Weight share of the clients it is
+	// selected for. The rest get the next PoP in the answers.
+	OverrideWeight OverrideMode = "weight"
+)
+
+// Override is a manual override of a PoP, set at runtime through the admin
+// API.
+type Override struct {
+	Mode OverrideMode `json:"mode"`
+
+	// [weight] The share of the clients kept, in (0, 1).
+	Weight float64 `json:"weight,omitempty"`
+
+	// The override lapses at this time. Never if zero.
+	Expires time.Time `json:"expires,omitzero"`
+
+	// Free-form note of the operator, e.g. a ticket number.
+	Reason string `json:"reason,omitempty"`
+}
+
+// activeAt returns whether the override is in effect at now.
+func (o Override) activeAt(now time.Time) bool {
+	return o.Mode != "" && (o.Expires.IsZero() || now.Before(o.Expires))
+}
+
+func (o Override) validate() error {
+	switch o.Mode {
+	case OverrideDrain, OverrideDisable:
+	case OverrideWeight:
+		if o.Weight <= 0 || o.Weight >= 1 {
+			return fmt.Errorf("Weight=%v must be a number between 0 and 1", o.Weight)
+		}
+	default:
+		return fmt.Errorf("Unknown override mode %q", o.Mode)
+	}
+	return nil
+}
+
+// SetOverride overrides the PoP of the id until o expires, replacing any
+// previous override of it.
+func (c *GslbCore) SetOverride(popId string, o Override) error {
+	i := slices.IndexFunc(c.cfg.Pops, func(p types.PoPInfo) bool { return p.Id == popId })
+	if i == -1 {
+		return fmt.Errorf("Unknown pop %q", popId)
+	}
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if o.Mode != OverrideWeight {
+		o.Weight = 0
+	}
+
+	slog.Warn("Overriding PoP",
+		slog.String("pop.Id", popId),
+		slog.String("mode", string(o.Mode)),
+		slog.Float64("weight", o.Weight),
+		slog.Time("expires", o.Expires),
+		slog.String("reason", o.Reason))
+
+	c.mu.Lock()
+	c.overrides[i] = o
+	c.serial++
+	c.mu.Unlock()
+	return nil
+}
+
+// ClearOverride puts the PoP of the id back in the GSLB's hands.
+func (c *GslbCore) ClearOverride(popId string) error {
+	i := slices.IndexFunc(c.cfg.Pops, func(p types.PoPInfo) bool { return p.Id == popId })
+	if i == -1 {
+		return fmt.Errorf("Unknown pop %q", popId)
+	}
+
+	slog.Warn("Clearing the override of PoP", slog.String("pop.Id", popId))
+
+	c.mu.Lock()
+	c.overrides[i] = Override{}
+	c.serial++
+	c.mu.Unlock()
+	return nil
+}
+
+// Overrides returns the overrides in effect, keyed by PoP id.
+func (c *GslbCore) Overrides() map[string]Override {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.overridesLocked(c.now())
+}
+
+func (c *GslbCore) overridesLocked(now time.Time) map[string]Override {
+	ret := make(map[string]Override)
+	for i, o := range c.overrides {
+		if o.activeAt(now) {
+			ret[c.cfg.Pops[i].Id] = o
+		}
+	}
+	return ret
+}
+
+// weightsLocked returns the share of the clients each PoP keeps: none if
+// it is disabled, its Weight if weighted down, and all of them otherwise.
+func (c *GslbCore) weightsLocked(now time.Time) []float64 {
+	weights := make([]float64, len(c.overrides))
+	for i, o := range c.overrides {
+		switch {
+		case !o.activeAt(now):
+			weights[i] = 1
+		case o.Mode == OverrideDisable:
+			weights[i] = 0
+		case o.Mode == OverrideWeight:
+			weights[i] = o.Weight
+		default:
+			weights[i] = 1
+		}
+	}
+	return weights
+}
+
+// keepsClient returns whether a PoP of the weight keeps the client.
+func keepsClient(srcIP netip.Addr, popId string, weight float64) bool {
+	return weight >= 1 || clientHash(srcIP, popId+"#weight") < weight
+}
+
+// demoteWeighted moves the PoPs not keeping the client, as decided by their
+// weights, behind the ones that do.
+func demoteWeighted(selected []int, pops []types.PoPInfo, weights []float64, srcIP netip.Addr) []int {
+	var kept, demoted []int
+	for _, i := range selected {
+		if keepsClient(srcIP, pops[i].Id, weights[i]) {
+			kept = append(kept, i)
+		} else {
+			demoted = append(demoted, i)
+		}
+	}
+	return append(kept, demoted...)
+}
@@ -0,0 +1,181 @@
+package gslbcore_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+)
+
+func TestOverrides(t *testing.T) {
+	clock := newTestClock()
+	cfg := newTestConfig()
+	cfg.Now = clock.Now
+	cfg.Answers = 3
+	c := startTestCore(t, cfg)
+
+	query := func(srcIP string) []string {
+		t.Helper()
+		var ret []string
+		for _, ip := range c.Query("www", netip.MustParseAddr(srcIP), gslbcore.IPv4) {
+			ret = append(ret, c.PopIdFromIP(ip))
+		}
+		return ret
+	}
+	set := func(popId string, o gslbcore.Override) {
+		t.Helper()
+		if err := c.SetOverride(popId, o); err != nil {
+			t.Fatalf("SetOverride(%s): %v", popId, err)
+		}
+	}
+	check := func(name string, want ...string) {
+		t.Helper()
+		if got := query("198.51.100.12"); !slices.Equal(got, want) {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+
+	// us-west: shibuya (50ms), akiba (80ms), shinjuku (100ms). atlantis is down.
+	check("initial", "shibuya", "akiba", "shinjuku")
+
+	set("shibuya", gslbcore.Override{Mode: gslbcore.OverrideDrain})
+	check("shibuya drained", "akiba", "shinjuku")
+
+	set("akiba", gslbcore.Override{Mode: gslbcore.OverrideDisable, Expires: clock.Now().Add(30 * time.Minute)})
+	check("akiba disabled", "shinjuku")
+
+	// Drained PoPs are answered fail-open, disabled ones aren't. shibuya
+	// stays first as the PoP us-west is settled on.
+	set("shinjuku", gslbcore.Override{Mode: gslbcore.OverrideDrain})
+	check("all drained", "shibuya", "atlantis", "shinjuku")
+
+	clock.Advance(time.Hour)
+	if _, ok := c.Overrides()["akiba"]; ok {
+		t.Errorf("the override of akiba hasn't expired")
+	}
+	if err := c.ClearOverride("shinjuku"); err != nil {
+		t.Fatalf("ClearOverride: %v", err)
+	}
+	check("akiba expired", "akiba", "shinjuku")
+	if err := c.ClearOverride("shibuya"); err != nil {
+		t.Fatalf("ClearOverride: %v", err)
+	}
+
+	set("shibuya", gslbcore.Override{Mode: gslbcore.OverrideWeight, Weight: 0.5})
+	kept := 0
+	for i := range 16 {
+		for _, base := range []int{0, 192} {
+			got := query(netip.AddrFrom4([4]byte{198, 51, 100, byte(base + i)}).String())
+			if got[0] == "shibuya" {
+				kept++
+			} else if !slices.Equal(got, []string{"akiba", "shinjuku", "shibuya"}) {
+				t.Errorf("weighted down: got %v, want shibuya demoted to the last", got)
+			}
+		}
+	}
+	if kept == 0 || kept == 32 {
+		t.Errorf("weighted down: shibuya kept %d of 32 clients", kept)
+	}
+
+	for _, tc := range []struct {
+		PopId    string
+		Override gslbcore.Override
+	}{
+		{"nowhere", gslbcore.Override{Mode: gslbcore.OverrideDrain}},
+		{"shibuya", gslbcore.Override{Mode: "maintenance"}},
+		{"shibuya", gslbcore.Override{Mode: gslbcore.OverrideWeight, Weight: 1.5}},
+		{"shibuya", gslbcore.Override{Mode: gslbcore.OverrideWeight}},
+	} {
+		if err := c.SetOverride(tc.PopId, tc.Override); err == nil {
+			t.Errorf("SetOverride(%s, %+v): expected an error", tc.PopId, tc.Override)
+		}
+	}
+}
+
+func TestOverrideAPI(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.AdminSecret = "s3cret"
+	c := gslbcore.New(cfg)
+	h := gslbcore.HTTPHandler(c)
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	testcases := []struct {
+		Method, Path, Token, Body string
+		Want                      int
+	}{
+		{"PUT", "/admin/pops/shibuya/override", "", `{"mode":"drain"}`, http.StatusUnauthorized},
+		{"PUT", "/admin/pops/shibuya/override", "wrong", `{"mode":"drain"}`, http.StatusUnauthorized},
+		{"PUT", "/admin/pops/nowhere/override", "s3cret", `{"mode":"drain"}`, http.StatusBadRequest},
+		{"PUT", "/admin/pops/shibuya/override", "s3cret", `{"mode":"drain","expires_in":"soon"}`, http.StatusBadRequest},
+		{"PUT", "/admin/pops/shibuya/override", "s3cret", `{"mode":"weight","weight":0.25,"expires_in":"1h","reason":"TICKET-1"}`, http.StatusNoContent},
+		{"PUT", "/admin/pops/akiba/override", "s3cret", `{"mode":"disable"}`, http.StatusNoContent},
+		{"DELETE", "/admin/pops/akiba/override", "s3cret", "", http.StatusNoContent},
+	}
+	for _, tc := range testcases {
+		if rec := do(tc.Method, tc.Path, tc.Token, tc.Body); rec.Code != tc.Want {
+			t.Errorf("%s %s %s: got %d, want %d: %s", tc.Method, tc.Path, tc.Body, rec.Code, tc.Want, rec.Body)
+		}
+	}
+
+	overrides := c.Overrides()
+	o, ok := overrides["shibuya"]
+	if len(overrides) != 1 || !ok || o.Mode != gslbcore.OverrideWeight || o.Weight != 0.25 || o.Reason != "TICKET-1" {
+		t.Errorf("Overrides: got %+v", overrides)
+	}
+	if d := time.Until(o.Expires); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("expires in %v, want 1h", d)
+	}
+
+	rec := do("GET", "/overrides.json", "", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"shibuya":{"mode":"weight","weight":0.25,`) {
+		t.Errorf("GET /overrides.json: got %d %s", rec.Code, rec.Body)
+	}
+
+	// The admin API is disabled without a secret.
+	cfg = newTestConfig()
+	h = gslbcore.HTTPHandler(gslbcore.New(cfg))
+	if rec := do("PUT", "/admin/pops/shibuya/override", "", `{"mode":"drain"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("without AdminSecret: got %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestRestoreOverrides(t *testing.T) {
+	clock := newTestClock()
+	cfg := newTestConfig()
+	cfg.Now = clock.Now
+	cfg.StateFile = filepath.Join(t.TempDir(), "state.json")
+	c := gslbcore.New(cfg)
+	if err := c.SetOverride("shibuya", gslbcore.Override{Mode: gslbcore.OverrideDrain, Reason: "maintenance"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetOverride("akiba", gslbcore.Override{Mode: gslbcore.OverrideDisable, Expires: clock.Now().Add(30 * time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SaveState(); err != nil {
+		t.Fatalf("SaveState: %v", err)
+	}
+	clock.Advance(time.Hour)
+
+	// The measurements are too old to restore, but the overrides aren't.
+	cfg.StateMaxAge = 10 * time.Minute
+	restored := gslbcore.New(cfg).Overrides()
+	if len(restored) != 1 || restored["shibuya"].Mode != gslbcore.OverrideDrain || restored["shibuya"].Reason != "maintenance" {
+		t.Errorf("restored overrides: got %+v", restored)
+	}
+}
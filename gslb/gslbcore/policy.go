@@ -0,0 +1,365 @@
+package gslbcore
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/yzp0n/ncdn/types"
+)
+
+// Snapshot is the state of the PoPs as seen by a query. Policies must not
+// modify it.
+type Snapshot struct {
+	Pops      []types.PoPInfo
+	PoPStatus []*types.PoPStatus
+
+	// Whether each PoP may be answered. If no PoP is healthy, all of them are
+	// marked so, since answering an erroring PoP is better than answering
+	// nothing.
+	Healthy []bool
+
+	// The region of the client, or nil if it isn't in any region.
+	Region *types.RegionInfo
+
+	// The latency from the client to each PoP. For clients not in any
+	// region, this is the latency averaged over all regions.
+	Latency []Latency
+
+	// The id of the PoP the client's region is settled on, if any, so that
+	// the answers don't flap between PoPs of similar latency. For clients
+	// not in any region, this is the default PoP. Ranked puts it first
+	// while it is healthy.
+	Preferred string
+}
+
+// PopIndex returns the index of the PoP with the id, or -1.
+func (s *Snapshot) PopIndex(id string) int {
+	return slices.IndexFunc(s.Pops, func(p types.PoPInfo) bool {
+		return p.Id == id
+	})
+}
+
+// Ranked returns the healthy PoPs ordered by ascending latency, with the
+// preferred PoP first. PoPs of unknown latency come last.
+func (s *Snapshot) Ranked() []int {
+	var ranked []int
+	for i := range s.Pops {
+		if s.Healthy[i] {
+			ranked = append(ranked, i)
+		}
+	}
+	slices.SortStableFunc(ranked, func(a, b int) int {
+		return s.Latency[a].Compare(s.Latency[b])
+	})
+	if i := s.PopIndex(s.Preferred); i != -1 && s.Healthy[i] {
+		ranked = promote(ranked, i)
+	}
+	return ranked
+}
+
+// Utilization returns the load of the PoP relative to its capacity.
+func (s *Snapshot) Utilization(i int) float64 {
+	capacity := s.Pops[i].Capacity
+	if capacity <= 0 {
+		return 0
+	}
+	return s.PoPStatus[i].Load / capacity
+}
+
+// Policy decides which PoPs to answer a client with.
+type Policy interface {
+	Name() string
+
+	// Select returns the indices of the PoPs to answer srcIP with, most
+	// preferred first. It is called concurrently.
+	Select(s *Snapshot, srcIP netip.Addr) []int
+}
+
+// promote returns the ranked PoPs with i moved to the front.
+func promote(ranked []int, i int) []int {
+	ret := []int{i}
+	for _, j := range ranked {
+		if j != i {
+			ret = append(ret, j)
+		}
+	}
+	return ret
+}
+
+// shuffleNearEqual returns the PoPs with each run of PoPs whose latency is
+// within the margin of the run's first one, either way, shuffled.
+func shuffleNearEqual(idxs []int, latency []Latency, margin float64) []int {
+	if margin <= 0 {
+		return idxs
+	}
+
+	ret := slices.Clone(idxs)
+	for i := 0; i < len(ret); {
+		head := latency[ret[i]]
+		j := i + 1
+		for j < len(ret) && head.Known && latency[ret[j]].Known &&
+			math.Abs(latency[ret[j]].Value-head.Value) <= math.Abs(head.Value)*margin {
+			j++
+		}
+		run := ret[i:j]
+		rand.Shuffle(len(run), func(a, b int) {
+			run[a], run[b] = run[b], run[a]
+		})
+		i = j
+	}
+	return ret
+}
+
+// NearestPolicy answers the healthy PoP with the lowest latency.
+type NearestPolicy struct{}
+
+func (NearestPolicy) Name() string { return "nearest" }
+
+func (NearestPolicy) Select(s *Snapshot, srcIP netip.Addr) []int {
+	return s.Ranked()
+}
+
+// StaticPolicy answers the first healthy PoP of a fixed list, regardless of
+// the client. If none of them is healthy, the nearest PoP is answered.
+type StaticPolicy struct {
+	PopIds []string
+}
+
+func (p *StaticPolicy) Name() string { return "static" }
+
+func (p *StaticPolicy) Select(s *Snapshot, srcIP netip.Addr) []int {
+	var ret []int
+	for _, id := range p.PopIds {
+		if i := s.PopIndex(id); i != -1 && s.Healthy[i] {
+			ret = append(ret, i)
+		}
+	}
+	if len(ret) == 0 {
+		return s.Ranked()
+	}
+	return ret
+}
+
+// GeoPolicy answers a fixed PoP per region. Clients of unmapped regions, or
+// whose PoP is unhealthy, get the nearest PoP.
+type GeoPolicy struct {
+	// region id -> PoP id
+	RegionPop map[string]string
+}
+
+func (p *GeoPolicy) Name() string { return "geo" }
+
+func (p *GeoPolicy) Select(s *Snapshot, srcIP netip.Addr) []int {
+	ranked := s.Ranked()
+	if s.Region == nil {
+		return ranked
+	}
+	if i := s.PopIndex(p.RegionPop[s.Region.Id]); i != -1 && s.Healthy[i] {
+		return promote(ranked, i)
+	}
+	return ranked
+}
+
+// WeightedRoundRobinPolicy spreads queries over the healthy PoPs in
+// proportion to their weights, using the smooth weighted round robin of
+// nginx. PoPs without a weight are only answered if no weighted PoP is
+// healthy.
+type WeightedRoundRobinPolicy struct {
+	// PoP id -> weight
+	Weights map[string]float64
+
+	mu      sync.Mutex
+	current map[string]float64
+}
+
+func (p *WeightedRoundRobinPolicy) Name() string { return "wrr" }
+
+func (p *WeightedRoundRobinPolicy) Select(s *Snapshot, srcIP netip.Addr) []int {
+	ranked := s.Ranked()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current == nil {
+		p.current = make(map[string]float64)
+	}
+
+	best := -1
+	total := 0.0
+	for _, i := range ranked {
+		id := s.Pops[i].Id
+		w := p.Weights[id]
+		if w <= 0 {
+			continue
+		}
+		total += w
+		p.current[id] += w
+		if best == -1 || p.current[id] > p.current[s.Pops[best].Id] {
+			best = i
+		}
+	}
+	if best == -1 {
+		return ranked
+	}
+	p.current[s.Pops[best].Id] -= total
+	return promote(ranked, best)
+}
+
+// SpilloverPolicy answers the nearest PoP until it nears its capacity. A PoP
+// whose utilization exceeds the threshold keeps only a share of the clients,
+// decided by hashing the client so that a given client keeps getting the
+// same answer while the load is stable. The rest spill over to the next
+// PoP in the ranking.
+type SpilloverPolicy struct {
+	// Clients start to spill over once a PoP's load exceeds this fraction
+	// of its capacity, and all of them do when the load reaches the
+	// capacity. Defaults to 0.8.
+	Threshold float64
+}
+
+func (p *SpilloverPolicy) Name() string { return "spillover" }
+
+func (p *SpilloverPolicy) Select(s *Snapshot, srcIP netip.Addr) []int {
+	ranked := s.Ranked()
+	if len(ranked) == 0 {
+		return nil
+	}
+
+	threshold := p.Threshold
+	if threshold <= 0 || threshold >= 1 {
+		threshold = 0.8
+	}
+
+	for _, i := range ranked {
+		keep := (1 - s.Utilization(i)) / (1 - threshold)
+		if clientHash(srcIP, s.Pops[i].Id) < keep {
+			return promote(ranked, i)
+		}
+	}
+
+	// Every PoP is saturated. Pick the least utilized one.
+	return promote(ranked, slices.MinFunc(ranked, func(a, b int) int {
+		return cmp.Compare(s.Utilization(a), s.Utilization(b))
+	}))
+}
+
+// clientHash maps the client and the PoP to a stable value in [0, 1).
+func clientHash(srcIP netip.Addr, popId string) float64 {
+	h := fnv.New64a()
+	_, _ = h.Write(srcIP.AsSlice())
+	_, _ = h.Write([]byte(popId))
+
+	// FNV alone barely changes the upper bits for adjacent addresses.
+	// Mix them with the MurmurHash3 finalizer.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return float64(x>>11) / (1 << 53)
+}
+
+// parseIdValue parses "id=value" arguments, checking the ids with known.
+func parseIdValue(args []string, known func(id string) bool) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, a := range args {
+		id, v, ok := strings.Cut(a, "=")
+		if !ok {
+			return nil, fmt.Errorf("Expected id=value, got %q", a)
+		}
+		if !known(id) {
+			return nil, fmt.Errorf("Unknown id %q", id)
+		}
+		m[id] = v
+	}
+	return m, nil
+}
+
+// ParsePolicy returns the built-in policy of the name configured with args,
+// validating the referenced PoPs and regions against cfg:
+//
+//	nearest
+//	static POP_ID...
+//	geo REGION_ID=POP_ID...
+//	wrr POP_ID=WEIGHT...
+//	spillover [THRESHOLD]
+func ParsePolicy(cfg *Config, name string, args []string) (Policy, error) {
+	isPop := func(id string) bool {
+		return slices.ContainsFunc(cfg.Pops, func(p types.PoPInfo) bool { return p.Id == id })
+	}
+	isRegion := func(id string) bool {
+		return slices.ContainsFunc(cfg.Regions, func(r types.RegionInfo) bool { return r.Id == id })
+	}
+
+	switch name {
+	case "nearest":
+		if len(args) != 0 {
+			return nil, fmt.Errorf("Policy %q takes no arguments", name)
+		}
+		return NearestPolicy{}, nil
+
+	case "static":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("Policy %q needs at least one PoP", name)
+		}
+		for _, id := range args {
+			if !isPop(id) {
+				return nil, fmt.Errorf("Unknown pop %q", id)
+			}
+		}
+		return &StaticPolicy{PopIds: args}, nil
+
+	case "geo":
+		m, err := parseIdValue(args, isRegion)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range m {
+			if !isPop(id) {
+				return nil, fmt.Errorf("Unknown pop %q", id)
+			}
+		}
+		return &GeoPolicy{RegionPop: m}, nil
+
+	case "wrr":
+		m, err := parseIdValue(args, isPop)
+		if err != nil {
+			return nil, err
+		}
+		weights := make(map[string]float64)
+		for id, s := range m {
+			w, err := strconv.ParseFloat(s, 64)
+			if err != nil || w < 0 {
+				return nil, fmt.Errorf("Failed to parse weight=%q of pop %q", s, id)
+			}
+			weights[id] = w
+		}
+		return &WeightedRoundRobinPolicy{Weights: weights}, nil
+
+	case "spillover":
+		p := &SpilloverPolicy{}
+		switch len(args) {
+		case 0:
+		case 1:
+			threshold, err := strconv.ParseFloat(args[0], 64)
+			if err != nil || threshold <= 0 || threshold >= 1 {
+				return nil, fmt.Errorf("Spillover threshold=%q must be a number between 0 and 1", args[0])
+			}
+			p.Threshold = threshold
+		default:
+			return nil, fmt.Errorf("Policy %q takes at most one argument", name)
+		}
+		return p, nil
+
+	default:
+		return nil, fmt.Errorf("Unknown policy %q", name)
+	}
+}
@@ -0,0 +1,162 @@
+package gslbcore_test
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+	"github.com/yzp0n/ncdn/types"
+)
+
+// newTestSnapshot returns the state seen by a us-west client of
+// newTestConfig: shibuya is the nearest healthy PoP, and atlantis is down.
+func newTestSnapshot() *gslbcore.Snapshot {
+	cfg := newTestConfig()
+	return &gslbcore.Snapshot{
+		Pops: cfg.Pops,
+		PoPStatus: []*types.PoPStatus{
+			{Load: 1},
+			{Load: 2},
+			{Load: 3},
+			{Error: "PoP is down."},
+		},
+		Healthy: []bool{true, true, true, false},
+		Region:  &cfg.Regions[0],
+		Latency: []gslbcore.Latency{
+			{Value: 100, Known: true},
+			{Value: 50, Known: true},
+			{Value: 80, Known: true},
+			{Value: 10, Known: true},
+		},
+	}
+}
+
+func popIds(s *gslbcore.Snapshot, idxs []int) []string {
+	ids := make([]string, len(idxs))
+	for i, idx := range idxs {
+		ids[i] = s.Pops[idx].Id
+	}
+	return ids
+}
+
+func TestPolicies(t *testing.T) {
+	srcIP := netip.MustParseAddr("198.51.100.12")
+
+	testcases := []struct {
+		Name   string
+		Policy []string
+		// Applied to the snapshot before selecting.
+		Modify func(s *gslbcore.Snapshot)
+		Want   []string
+	}{
+		{
+			Name:   "nearest",
+			Policy: []string{"nearest"},
+			Want:   []string{"shibuya", "akiba", "shinjuku"},
+		},
+		{
+			Name:   "nearest-unknown",
+			Policy: []string{"nearest"},
+			Modify: func(s *gslbcore.Snapshot) { s.Latency[1] = gslbcore.Latency{} },
+			Want:   []string{"akiba", "shinjuku", "shibuya"},
+		},
+		{
+			Name:   "static",
+			Policy: []string{"static", "atlantis", "akiba"},
+			Want:   []string{"akiba"},
+		},
+		{
+			Name:   "static-all-down",
+			Policy: []string{"static", "atlantis"},
+			Want:   []string{"shibuya", "akiba", "shinjuku"},
+		},
+		{
+			Name:   "geo",
+			Policy: []string{"geo", "us-west=shinjuku", "tokyo=akiba"},
+			Want:   []string{"shinjuku", "shibuya", "akiba"},
+		},
+		{
+			Name:   "geo-unmapped",
+			Policy: []string{"geo", "tokyo=akiba"},
+			Want:   []string{"shibuya", "akiba", "shinjuku"},
+		},
+		{
+			Name:   "geo-no-region",
+			Policy: []string{"geo", "us-west=shinjuku"},
+			Modify: func(s *gslbcore.Snapshot) { s.Region = nil },
+			Want:   []string{"shibuya", "akiba", "shinjuku"},
+		},
+		{
+			Name:   "spillover-below-threshold",
+			Policy: []string{"spillover"},
+			Want:   []string{"shibuya", "akiba", "shinjuku"},
+		},
+		{
+			Name:   "spillover-saturated",
+			Policy: []string{"spillover", "0.5"},
+			Modify: func(s *gslbcore.Snapshot) {
+				s.Pops[1].Capacity = 2 // shibuya
+				s.Pops[2].Capacity = 3 // akiba
+			},
+			Want: []string{"shinjuku", "shibuya", "akiba"},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			s := newTestSnapshot()
+			if tc.Modify != nil {
+				tc.Modify(s)
+			}
+			p, err := gslbcore.ParsePolicy(newTestConfig(), tc.Policy[0], tc.Policy[1:])
+			if err != nil {
+				t.Fatalf("ParsePolicy(%v): %v", tc.Policy, err)
+			}
+
+			got := popIds(s, p.Select(s, srcIP))
+			if !slices.Equal(got, tc.Want) {
+				t.Errorf("%s.Select: got %v, want %v", p.Name(), got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestWeightedRoundRobinPolicy(t *testing.T) {
+	s := newTestSnapshot()
+	p, err := gslbcore.ParsePolicy(newTestConfig(), "wrr", []string{"shinjuku=3", "shibuya=1", "atlantis=5"})
+	if err != nil {
+		t.Fatalf("ParsePolicy: %v", err)
+	}
+
+	var got []string
+	for range 8 {
+		got = append(got, s.Pops[p.Select(s, netip.Addr{})[0]].Id)
+	}
+	// atlantis is down, and akiba has no weight. Ties go to the nearer PoP.
+	want := []string{
+		"shinjuku", "shibuya", "shinjuku", "shinjuku",
+		"shinjuku", "shibuya", "shinjuku", "shinjuku",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	testcases := [][]string{
+		{"fastest"},
+		{"nearest", "shinjuku"},
+		{"static"},
+		{"static", "narnia"},
+		{"geo", "us-west"},
+		{"geo", "mars=shinjuku"},
+		{"geo", "us-west=narnia"},
+		{"wrr", "shinjuku=-1"},
+		{"spillover", "1.5"},
+	}
+	for _, args := range testcases {
+		if _, err := gslbcore.ParsePolicy(newTestConfig(), args[0], args[1:]); err == nil {
+			t.Errorf("ParsePolicy(%v): expected an error", args)
+		}
+	}
+}
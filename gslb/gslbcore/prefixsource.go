@@ -0,0 +1,162 @@
+package gslbcore
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/yzp0n/ncdn/types"
+)
+
+// LoadPrefixSource reads the prefixes listed by src.
+func LoadPrefixSource(src types.PrefixSource) ([]netip.Prefix, error) {
+	var ps []netip.Prefix
+	var err error
+	switch src.Format {
+	case "csv":
+		ps, err = loadPrefixCSV(src.Path)
+	case "mmdb":
+		ps, err = loadPrefixMMDB(src.Path, src.Country, src.ASNs)
+	case "bgpdump":
+		ps, err = loadPrefixBGPDump(src.Path, src.ASNs)
+	default:
+		return nil, fmt.Errorf("Unknown prefix source format %q", src.Format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load prefixes from %s: %v", src.Path, err)
+	}
+	return ps, nil
+}
+
+// loadPrefixCSV reads a CSV file with a prefix in the first column of each
+// row. Other columns are ignored, as is a header row and lines starting
+// with '#'.
+func loadPrefixCSV(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+
+	var ps []netip.Prefix
+	for row := 1; ; row++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		s := strings.TrimSpace(rec[0])
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			if row == 1 {
+				continue
+			}
+			line, _ := r.FieldPos(0)
+			return nil, fmt.Errorf("line %d: Failed to parse prefix=%q: %v", line, s, err)
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// loadPrefixMMDB reads the networks of the country, or originated by the
+// ASNs, from a MaxMind DB file such as GeoLite2-Country or GeoLite2-ASN.
+func loadPrefixMMDB(path string, country string, asns []uint32) ([]netip.Prefix, error) {
+	if country == "" && len(asns) == 0 {
+		return nil, errors.New("Either a country or ASNs are required for mmdb")
+	}
+
+	r, err := openMMDB(path)
+	if err != nil {
+		return nil, err
+	}
+	return r.networks(func(record any) bool {
+		m, ok := record.(map[string]any)
+		if !ok {
+			return false
+		}
+		if country != "" {
+			c, _ := m["country"].(map[string]any)
+			if code, _ := c["iso_code"].(string); strings.EqualFold(code, country) {
+				return true
+			}
+		}
+		if asn, ok := m["autonomous_system_number"].(uint64); ok {
+			return slices.Contains(asns, uint32(asn))
+		}
+		return false
+	})
+}
+
+// loadPrefixBGPDump reads the prefixes originated by the ASNs from the
+// output of `bgpdump -m`, i.e. lines like:
+//
+//	TABLE_DUMP2|1700000000|B|192.0.2.1|64500|198.51.100.0/24|64500 64501|IGP|...
+//
+// All announced prefixes are taken if asns is empty.
+func loadPrefixBGPDump(path string, asns []uint32) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seen := make(map[netip.Prefix]struct{})
+	var ps []netip.Prefix
+
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Split(s.Text(), "|")
+		if len(fields) < 7 {
+			continue
+		}
+		// Withdrawals and state changes don't carry an AS path.
+		if fields[2] != "B" && fields[2] != "A" {
+			continue
+		}
+
+		p, err := netip.ParsePrefix(fields[5])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: Failed to parse prefix=%q: %v", line, fields[5], err)
+		}
+		if _, ok := seen[p]; ok {
+			continue
+		}
+
+		if len(asns) > 0 {
+			path := strings.Fields(fields[6])
+			if len(path) == 0 {
+				continue
+			}
+			// The origin may be an AS set, e.g. "{64500,64501}".
+			origin := strings.Trim(path[len(path)-1], "{}")
+			if !slices.ContainsFunc(strings.Split(origin, ","), func(s string) bool {
+				asn, err := strconv.ParseUint(s, 10, 32)
+				return err == nil && slices.Contains(asns, uint32(asn))
+			}) {
+				continue
+			}
+		}
+
+		seen[p] = struct{}{}
+		ps = append(ps, p)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
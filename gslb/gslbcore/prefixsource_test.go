@@ -0,0 +1,132 @@
+package gslbcore_test
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+	"github.com/yzp0n/ncdn/types"
+)
+
+func TestLoadPrefixSource(t *testing.T) {
+	testcases := []struct {
+		Name   string
+		Source types.PrefixSource
+		Want   []string
+	}{
+		{
+			Name:   "csv",
+			Source: types.PrefixSource{Format: "csv", Path: "testdata/regions.csv"},
+			Want:   []string{"203.0.113.0/25", "203.0.113.128/26", "2001:db8:100::/48"},
+		},
+		{
+			Name:   "mmdb-country",
+			Source: types.PrefixSource{Format: "mmdb", Path: "testdata/regions.mmdb", Country: "jp"},
+			Want:   []string{"192.0.2.0/25", "192.0.2.128/25", "2001:db8::/33"},
+		},
+		{
+			Name:   "mmdb-asn",
+			Source: types.PrefixSource{Format: "mmdb", Path: "testdata/regions.mmdb", ASNs: []uint32{64500, 64502}},
+			Want:   []string{"192.0.2.0/25", "198.51.100.0/24", "2001:db8::/33"},
+		},
+		{
+			Name:   "bgpdump-asn",
+			Source: types.PrefixSource{Format: "bgpdump", Path: "testdata/rib.txt", ASNs: []uint32{64500, 64503}},
+			Want:   []string{"192.0.2.0/24", "203.0.113.0/24", "2001:db8::/32"},
+		},
+		{
+			Name:   "bgpdump-all",
+			Source: types.PrefixSource{Format: "bgpdump", Path: "testdata/rib.txt"},
+			Want:   []string{"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24", "2001:db8::/32"},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ps, err := gslbcore.LoadPrefixSource(tc.Source)
+			if err != nil {
+				t.Fatalf("LoadPrefixSource: %v", err)
+			}
+
+			got := make([]string, len(ps))
+			for i, p := range ps {
+				got[i] = p.String()
+			}
+			slices.Sort(got)
+			want := slices.Sorted(slices.Values(tc.Want))
+			if !slices.Equal(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadPrefixSourceErrors(t *testing.T) {
+	for _, src := range []types.PrefixSource{
+		{Format: "txt", Path: "testdata/regions.csv"},
+		{Format: "csv", Path: "testdata/missing.csv"},
+		{Format: "csv", Path: "testdata/rib.txt"},
+		{Format: "mmdb", Path: "testdata/regions.mmdb"},
+		{Format: "mmdb", Path: "testdata/regions.csv", Country: "JP"},
+	} {
+		if _, err := gslbcore.LoadPrefixSource(src); err == nil {
+			t.Errorf("LoadPrefixSource(%+v): expected an error", src)
+		}
+	}
+}
+
+func TestReloadPrefixes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prefixes.csv")
+	if err := os.WriteFile(path, []byte("203.0.113.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newTestConfig()
+	cfg.Regions[1].PrefixSources = []types.PrefixSource{{Format: "csv", Path: path}}
+	cfg.Policy = &gslbcore.GeoPolicy{RegionPop: map[string]string{"us-east": "akiba"}}
+	c := gslbcore.New(cfg)
+
+	query := func() string {
+		t.Helper()
+		rs := c.Query("www", netip.MustParseAddr("203.0.113.1"), gslbcore.IPv4)
+		if len(rs) != 1 {
+			t.Fatalf("Query: got %v, want 1 answer", rs)
+		}
+		return rs[0].String()
+	}
+
+	// Not in any region before the prefixes are loaded.
+	if got := query(); got != "192.0.2.1" {
+		t.Errorf("before loading: got %s, want 192.0.2.1", got)
+	}
+
+	if err := c.ReloadPrefixes(); err != nil {
+		t.Fatalf("ReloadPrefixes: %v", err)
+	}
+	if got := query(); got != "192.0.2.3" {
+		t.Errorf("after loading: got %s, want 192.0.2.3", got)
+	}
+
+	// A broken source keeps the previous prefixes.
+	if err := os.WriteFile(path, []byte("203.0.113.0/24\nbroken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReloadPrefixes(); err == nil {
+		t.Errorf("ReloadPrefixes: expected an error")
+	}
+	if got := query(); got != "192.0.2.3" {
+		t.Errorf("after failed reload: got %s, want 192.0.2.3", got)
+	}
+
+	if err := os.WriteFile(path, []byte("192.0.2.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReloadPrefixes(); err != nil {
+		t.Fatalf("ReloadPrefixes: %v", err)
+	}
+	if got := query(); got != "192.0.2.1" {
+		t.Errorf("after the prefix is removed: got %s, want 192.0.2.1", got)
+	}
+}
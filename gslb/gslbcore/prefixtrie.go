@@ -0,0 +1,148 @@
+package gslbcore
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+
+	"github.com/yzp0n/ncdn/types"
+)
+
+// uint128 holds an address with its first bit at the MSB of hi. IPv4
+// addresses take the upper 32 bits of hi.
+type uint128 struct {
+	hi, lo uint64
+}
+
+func addrBits(a netip.Addr) uint128 {
+	if a.Is4() {
+		b := a.As4()
+		return uint128{hi: uint64(binary.BigEndian.Uint32(b[:])) << 32}
+	}
+	b := a.As16()
+	return uint128{hi: binary.BigEndian.Uint64(b[:8]), lo: binary.BigEndian.Uint64(b[8:])}
+}
+
+// bit returns the i-th bit counting from the MSB.
+func (u uint128) bit(i int) int {
+	if i < 64 {
+		return int(u.hi>>(63-i)) & 1
+	}
+	return int(u.lo>>(127-i)) & 1
+}
+
+func (u uint128) setBit(i int) uint128 {
+	if i < 64 {
+		u.hi |= 1 << (63 - i)
+	} else {
+		u.lo |= 1 << (127 - i)
+	}
+	return u
+}
+
+// commonPrefixLen returns the number of leading bits shared by u and v.
+func (u uint128) commonPrefixLen(v uint128) int {
+	if x := u.hi ^ v.hi; x != 0 {
+		return bits.LeadingZeros64(x)
+	}
+	return 64 + bits.LeadingZeros64(u.lo^v.lo)
+}
+
+// trieNode is a node of a path-compressed binary trie (Patricia trie). The
+// node covers the first `bits` bits of `key`, and its children branch on the
+// next bit.
+type trieNode struct {
+	key    uint128
+	bits   int
+	prefix netip.Prefix
+
+	// The region of the prefix, or -1 for a branching-only node.
+	region int
+
+	child [2]*trieNode
+}
+
+// regionTrie finds the region with the longest prefix containing an
+// address, in time proportional to the address length.
+type regionTrie struct {
+	v4, v6 *trieNode
+}
+
+func newRegionTrie(regions []types.RegionInfo) *regionTrie {
+	t := &regionTrie{}
+	for i, r := range regions {
+		for _, p := range r.Prefixes {
+			t.insert(p, i)
+		}
+	}
+	return t
+}
+
+func (t *regionTrie) insert(p netip.Prefix, region int) {
+	p = p.Masked()
+	np := &t.v6
+	if p.Addr().Is4() {
+		np = &t.v4
+	}
+	key := addrBits(p.Addr())
+
+	for {
+		n := *np
+		if n == nil {
+			*np = &trieNode{key: key, bits: p.Bits(), prefix: p, region: region}
+			return
+		}
+
+		common := min(key.commonPrefixLen(n.key), p.Bits(), n.bits)
+		if common == n.bits {
+			if p.Bits() == n.bits {
+				// The region declared first wins a duplicated prefix.
+				if n.region == -1 {
+					n.prefix = p
+					n.region = region
+				}
+				return
+			}
+			np = &n.child[key.bit(n.bits)]
+			continue
+		}
+
+		leaf := &trieNode{key: key, bits: p.Bits(), prefix: p, region: region}
+		if common == p.Bits() {
+			// p contains n.
+			leaf.child[n.key.bit(common)] = n
+			*np = leaf
+			return
+		}
+		branch := &trieNode{key: key, bits: common, region: -1}
+		branch.child[key.bit(common)] = leaf
+		branch.child[n.key.bit(common)] = n
+		*np = branch
+		return
+	}
+}
+
+// lookup returns the index of the region with the longest prefix containing
+// ip and the prefix, or -1 if there is none.
+func (t *regionTrie) lookup(ip netip.Addr) (int, netip.Prefix) {
+	ip = ip.Unmap()
+	n := t.v6
+	if ip.Is4() {
+		n = t.v4
+	}
+	key := addrBits(ip)
+
+	best := -1
+	var bestPrefix netip.Prefix
+	for n != nil && key.commonPrefixLen(n.key) >= n.bits {
+		if n.region != -1 {
+			best = n.region
+			bestPrefix = n.prefix
+		}
+		if n.bits == ip.BitLen() {
+			break
+		}
+		n = n.child[key.bit(n.bits)]
+	}
+	return best, bestPrefix
+}
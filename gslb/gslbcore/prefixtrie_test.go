@@ -0,0 +1,161 @@
+package gslbcore_test
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+	"github.com/yzp0n/ncdn/types"
+)
+
+// findRegionLinear is the reference implementation of the region lookup.
+func findRegionLinear(regions []types.RegionInfo, ip netip.Addr) (int, netip.Prefix) {
+	ip = ip.Unmap()
+	best := -1
+	var bestPrefix netip.Prefix
+	for i, r := range regions {
+		for _, p := range r.Prefixes {
+			if p.Contains(ip) && (best == -1 || p.Bits() > bestPrefix.Bits()) {
+				best = i
+				bestPrefix = p
+			}
+		}
+	}
+	return best, bestPrefix
+}
+
+func randomAddr(rnd *rand.Rand, v6 bool) netip.Addr {
+	if v6 {
+		var b [16]byte
+		b[0] = 0x20 // keep within 2000::/8 so that prefixes overlap
+		for i := 1; i < len(b); i++ {
+			b[i] = byte(rnd.IntN(256))
+		}
+		return netip.AddrFrom16(b)
+	}
+	var b [4]byte
+	b[0] = byte(10 + rnd.IntN(4))
+	for i := 1; i < len(b); i++ {
+		b[i] = byte(rnd.IntN(256))
+	}
+	return netip.AddrFrom4(b)
+}
+
+// randomRegions returns regions with n random prefixes in total, of
+// lengths from /8 to /24 for IPv4 and /16 to /64 for IPv6.
+func randomRegions(rnd *rand.Rand, numRegions, n int) []types.RegionInfo {
+	regions := make([]types.RegionInfo, numRegions)
+	for i := range regions {
+		regions[i].Id = fmt.Sprintf("region-%d", i)
+	}
+	for range n {
+		v6 := rnd.IntN(4) == 0
+		bits := 8 + rnd.IntN(17)
+		if v6 {
+			bits = 16 + rnd.IntN(49)
+		}
+		p := netip.PrefixFrom(randomAddr(rnd, v6), bits).Masked()
+
+		r := &regions[rnd.IntN(numRegions)]
+		r.Prefixes = append(r.Prefixes, p)
+	}
+	return regions
+}
+
+func TestRegionLookup(t *testing.T) {
+	regions := []types.RegionInfo{
+		{
+			Id: "a",
+			Prefixes: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/8"),
+				netip.MustParsePrefix("10.1.2.0/24"),
+				netip.MustParsePrefix("2001:db8::/32"),
+			},
+		},
+		{
+			Id: "b",
+			Prefixes: []netip.Prefix{
+				netip.MustParsePrefix("10.1.0.0/16"),
+				netip.MustParsePrefix("10.1.2.0/24"), // duplicated: "a" wins
+				netip.MustParsePrefix("2001:db8:1::/48"),
+				netip.MustParsePrefix("192.0.2.1/32"),
+			},
+		},
+	}
+	lookup := gslbcore.CompileRegions(regions)
+
+	testcases := []struct {
+		Ip         string
+		WantRegion int
+		WantPrefix string
+	}{
+		{"10.9.9.9", 0, "10.0.0.0/8"},
+		{"10.1.9.9", 1, "10.1.0.0/16"},
+		{"10.1.2.3", 0, "10.1.2.0/24"},
+		{"::ffff:10.1.9.9", 1, "10.1.0.0/16"},
+		{"192.0.2.1", 1, "192.0.2.1/32"},
+		{"192.0.2.2", -1, "invalid Prefix"},
+		{"2001:db8:1::1", 1, "2001:db8:1::/48"},
+		{"2001:db8:2::1", 0, "2001:db8::/32"},
+		{"2001:db9::1", -1, "invalid Prefix"},
+	}
+	for _, tc := range testcases {
+		region, prefix := lookup(netip.MustParseAddr(tc.Ip))
+		if region != tc.WantRegion || prefix.String() != tc.WantPrefix {
+			t.Errorf("lookup(%s): got (%d, %s), want (%d, %s)", tc.Ip, region, prefix, tc.WantRegion, tc.WantPrefix)
+		}
+	}
+}
+
+func TestRegionLookupRandom(t *testing.T) {
+	rnd := rand.New(rand.NewPCG(1, 2))
+	regions := randomRegions(rnd, 10, 2000)
+	lookup := gslbcore.CompileRegions(regions)
+
+	for range 10000 {
+		ip := randomAddr(rnd, rnd.IntN(4) == 0)
+		gotRegion, gotPrefix := lookup(ip)
+		wantRegion, wantPrefix := findRegionLinear(regions, ip)
+		if gotRegion != wantRegion || gotPrefix != wantPrefix {
+			t.Fatalf("lookup(%s): got (%d, %s), want (%d, %s)", ip, gotRegion, gotPrefix, wantRegion, wantPrefix)
+		}
+	}
+}
+
+func benchmarkRegionLookup(b *testing.B, lookup func(ip netip.Addr) (int, netip.Prefix), rnd *rand.Rand) {
+	ips := make([]netip.Addr, 1024)
+	for i := range ips {
+		ips[i] = randomAddr(rnd, i%4 == 0)
+	}
+
+	for i := 0; b.Loop(); i++ {
+		lookup(ips[i%len(ips)])
+	}
+}
+
+func BenchmarkRegionLookup(b *testing.B) {
+	for _, n := range []int{100, 10000, 50000} {
+		b.Run(fmt.Sprintf("trie-%d", n), func(b *testing.B) {
+			rnd := rand.New(rand.NewPCG(1, 2))
+			regions := randomRegions(rnd, 10, n)
+			benchmarkRegionLookup(b, gslbcore.CompileRegions(regions), rnd)
+		})
+		b.Run(fmt.Sprintf("linear-%d", n), func(b *testing.B) {
+			rnd := rand.New(rand.NewPCG(1, 2))
+			regions := randomRegions(rnd, 10, n)
+			benchmarkRegionLookup(b, func(ip netip.Addr) (int, netip.Prefix) {
+				return findRegionLinear(regions, ip)
+			}, rnd)
+		})
+	}
+}
+
+func BenchmarkCompileRegions(b *testing.B) {
+	rnd := rand.New(rand.NewPCG(1, 2))
+	regions := randomRegions(rnd, 10, 50000)
+	for b.Loop() {
+		gslbcore.CompileRegions(regions)
+	}
+}
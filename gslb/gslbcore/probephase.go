@@ -0,0 +1,113 @@
+package gslbcore
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/yzp0n/ncdn/types"
+)
+
+// ProbePhase is the span of a types.ProbeResult taken as the latency, from
+// one of its timestamps to a later one. The timestamps are named by their
+// JSON keys.
+type ProbePhase struct {
+	From, To string
+}
+
+var (
+	// Time to first byte, including the server think time. The default.
+	PhaseFirstByte = ProbePhase{"start", "first_byte"}
+
+	// Time to connect, excluding the name lookup. It is the best proxy for
+	// the network distance, as it takes a single round trip for plain
+	// HTTP. TLS handshakes add more.
+	PhaseConnect = ProbePhase{"dns_end", "connect_end"}
+
+	// Time to look up the name of the PoP, zero if the URL has an address.
+	PhaseDNS = ProbePhase{"start", "dns_end"}
+
+	// Time to receive the whole response.
+	PhaseResponse = ProbePhase{"start", "response_end"}
+)
+
+var namedPhases = map[string]ProbePhase{
+	"ttfb":     PhaseFirstByte,
+	"connect":  PhaseConnect,
+	"dns":      PhaseDNS,
+	"response": PhaseResponse,
+}
+
+// The timestamps of types.ProbeResult, in the order they are taken.
+var probeTimestamps = []string{"start", "dns_end", "connect_end", "request_end", "first_byte", "response_end"}
+
+func probeTimestamp(res *types.ProbeResult, name string) int64 {
+	switch name {
+	case "start":
+		return res.Start
+	case "dns_end":
+		// Without a name lookup, the connection starts right away.
+		if res.DNSEnd == 0 {
+			return res.Start
+		}
+		return res.DNSEnd
+	case "connect_end":
+		return res.ConnectEnd
+	case "request_end":
+		return res.RequestEnd
+	case "first_byte":
+		return res.FirstByte
+	default:
+		return res.ResponseEnd
+	}
+}
+
+// ParseProbePhase parses the phase named "ttfb", "connect", "dns" or
+// "response", or a custom one as "FROM..TO", e.g. "request_end..first_byte".
+// The empty string is "ttfb".
+func ParseProbePhase(s string) (ProbePhase, error) {
+	if s == "" {
+		return PhaseFirstByte, nil
+	}
+	if p, ok := namedPhases[s]; ok {
+		return p, nil
+	}
+
+	from, to, ok := strings.Cut(s, "..")
+	if !ok {
+		return ProbePhase{}, fmt.Errorf("Unknown probe phase %q", s)
+	}
+	fromIdx := slices.Index(probeTimestamps, from)
+	if fromIdx == -1 {
+		return ProbePhase{}, fmt.Errorf("Unknown probe timestamp %q, must be one of %v", from, probeTimestamps)
+	}
+	toIdx := slices.Index(probeTimestamps, to)
+	if toIdx == -1 {
+		return ProbePhase{}, fmt.Errorf("Unknown probe timestamp %q, must be one of %v", to, probeTimestamps)
+	}
+	if toIdx <= fromIdx {
+		return ProbePhase{}, fmt.Errorf("Probe phase %q must end after it starts", s)
+	}
+	return ProbePhase{from, to}, nil
+}
+
+func (p ProbePhase) String() string {
+	for name, np := range namedPhases {
+		if np == p {
+			return name
+		}
+	}
+	return p.From + ".." + p.To
+}
+
+// Measure returns the length of the phase in res, in milliseconds.
+func (p ProbePhase) Measure(res *types.ProbeResult) (float64, error) {
+	from, to := probeTimestamp(res, p.From), probeTimestamp(res, p.To)
+	if from == 0 || to == 0 {
+		return 0, fmt.Errorf("Prober didn't report the %s phase", p)
+	}
+	if to < from {
+		return 0, fmt.Errorf("Prober reported the %s phase ending before it starts", p)
+	}
+	return float64(to-from) / 1e6, nil
+}
@@ -0,0 +1,96 @@
+package gslbcore_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+	"github.com/yzp0n/ncdn/types"
+)
+
+// testProbeResult took 2ms to look up the name, 10ms to connect, 1ms to
+// send the request, 30ms until the first byte, and 5ms for the rest.
+var testProbeResult = types.ProbeResult{
+	Start:       1_000_000_000,
+	DNSEnd:      1_002_000_000,
+	ConnectEnd:  1_012_000_000,
+	RequestEnd:  1_013_000_000,
+	FirstByte:   1_043_000_000,
+	ResponseEnd: 1_048_000_000,
+}
+
+func TestProbePhase(t *testing.T) {
+	noDNS := testProbeResult
+	noDNS.DNSEnd = 0
+	oldProber := testProbeResult
+	oldProber.ResponseEnd = 0
+
+	testcases := []struct {
+		Phase  string
+		Result types.ProbeResult
+		Want   float64
+		Err    bool
+	}{
+		{Phase: "", Result: testProbeResult, Want: 43},
+		{Phase: "ttfb", Result: testProbeResult, Want: 43},
+		{Phase: "connect", Result: testProbeResult, Want: 10},
+		{Phase: "dns", Result: testProbeResult, Want: 2},
+		{Phase: "response", Result: testProbeResult, Want: 48},
+		{Phase: "request_end..first_byte", Result: testProbeResult, Want: 30},
+		// Without a name lookup, connecting starts right away.
+		{Phase: "connect", Result: noDNS, Want: 12},
+		{Phase: "dns", Result: noDNS, Want: 0},
+		{Phase: "response", Result: oldProber, Err: true},
+	}
+	for _, tc := range testcases {
+		p, err := gslbcore.ParseProbePhase(tc.Phase)
+		if err != nil {
+			t.Fatalf("ParseProbePhase(%q): %v", tc.Phase, err)
+		}
+		got, err := p.Measure(&tc.Result)
+		if (err != nil) != tc.Err {
+			t.Errorf("%s: got error %v, want error %v", p, err, tc.Err)
+			continue
+		}
+		if got != tc.Want {
+			t.Errorf("%s: got %v, want %v", p, got, tc.Want)
+		}
+	}
+
+	for _, s := range []string{"rtt", "first_byte..start", "start..end", "start..start"} {
+		if _, err := gslbcore.ParseProbePhase(s); err == nil {
+			t.Errorf("ParseProbePhase(%q): got no error", s)
+		}
+	}
+}
+
+func TestProbeOverJSONRPCPhase(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(&testProbeResult)
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		Phase gslbcore.ProbePhase
+		Want  float64
+	}{
+		{Phase: gslbcore.ProbePhase{}, Want: 43},
+		{Phase: gslbcore.PhaseConnect, Want: 10},
+	} {
+		lm := gslbcore.ProbeOverJSONRPC{ProberURL: srv.URL, Secret: "secret", Phase: tc.Phase}
+		got, err := lm.MeasureLatency(context.Background(), "http://192.0.2.1/latencyz")
+		if err != nil {
+			t.Fatalf("%s: %v", lm.DebugString(), err)
+		}
+		if got != tc.Want {
+			t.Errorf("%s: got %v, want %v", lm.DebugString(), got, tc.Want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package gslbcore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// DNSQuery is a query received by the DNS server.
+type DNSQuery struct {
+	Service string
+	Family  Family
+
+	// The resolver the query came from, and the client subnet it forwarded
+	// in EDNS, if any.
+	Resolver     netip.Addr
+	ClientSubnet netip.Prefix
+}
+
+// QueryLogEntry records how a DNS query was answered.
+type QueryLogEntry struct {
+	Time         time.Time    `json:"time"`
+	Service      string       `json:"service"`
+	Family       Family       `json:"family"`
+	Resolver     netip.Addr   `json:"resolver"`
+	ClientSubnet netip.Prefix `json:"client_subnet,omitzero"`
+	Region       string       `json:"region,omitempty"`
+	PopIds       []string     `json:"pop_ids"`
+}
+
+// QueryStats counts the DNS answers by the region of the client, and the
+// PoP answered first. Clients not in any region are counted under "".
+type QueryStats struct {
+	Since  time.Time                    `json:"since"`
+	Total  uint64                       `json:"total"`
+	Counts map[string]map[string]uint64 `json:"counts"`
+}
+
+// queryLog keeps the latest DNS decisions in a ring buffer, and the counts
+// of all of them. If a file is set, the entries are also appended to it as
+// JSON lines by a writer of Run.
+type queryLog struct {
+	mu    sync.Mutex
+	ring  []QueryLogEntry
+	next  int
+	full  bool
+	stats QueryStats
+
+	// Entries to be written to the file. Dropped if the writer lags.
+	fileC   chan QueryLogEntry
+	dropped uint64
+}
+
+func newQueryLog(size int, withFile bool, now time.Time) *queryLog {
+	l := &queryLog{
+		ring: make([]QueryLogEntry, size),
+		stats: QueryStats{
+			Since:  now,
+			Counts: make(map[string]map[string]uint64),
+		},
+	}
+	if withFile {
+		l.fileC = make(chan QueryLogEntry, 1024)
+	}
+	return l
+}
+
+func (l *queryLog) record(e QueryLogEntry) {
+	l.mu.Lock()
+	l.ring[l.next] = e
+	l.next = (l.next + 1) % len(l.ring)
+	l.full = l.full || l.next == 0
+
+	l.stats.Total++
+	if len(e.PopIds) > 0 {
+		m := l.stats.Counts[e.Region]
+		if m == nil {
+			m = make(map[string]uint64)
+			l.stats.Counts[e.Region] = m
+		}
+		m[e.PopIds[0]]++
+	}
+	l.mu.Unlock()
+
+	if l.fileC != nil {
+		select {
+		case l.fileC <- e:
+		default:
+			l.mu.Lock()
+			l.dropped++
+			l.mu.Unlock()
+		}
+	}
+}
+
+// recent returns up to n of the latest entries, newest first.
+func (l *queryLog) recent(n int) []QueryLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	size := l.next
+	if l.full {
+		size = len(l.ring)
+	}
+	n = min(n, size)
+	ret := make([]QueryLogEntry, n)
+	for i := range ret {
+		ret[i] = l.ring[(l.next-1-i+len(l.ring))%len(l.ring)]
+	}
+	return ret
+}
+
+func (l *queryLog) statsCopy() QueryStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	st := l.stats
+	st.Counts = make(map[string]map[string]uint64)
+	for region, m := range l.stats.Counts {
+		st.Counts[region] = make(map[string]uint64)
+		for popId, n := range m {
+			st.Counts[region][popId] = n
+		}
+	}
+	return st
+}
+
+// OpenQueryLogFile opens the file to append the query log to.
+func OpenQueryLogFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open the query log: %w", err)
+	}
+	return f, nil
+}
+
+// runFileWriter appends the entries to the file until ctx is done, and then
+// those queued by then. It closes the file.
+func (l *queryLog) runFileWriter(ctx context.Context, f *os.File) {
+	defer f.Close()
+	path := f.Name()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	write := func(e *QueryLogEntry) {
+		if err := enc.Encode(e); err != nil {
+			slog.Error("Failed to encode a query log entry", slog.String("error", err.Error()))
+		}
+	}
+	flush := func() {
+		if err := w.Flush(); err != nil {
+			slog.Error("Failed to write the query log", slog.String("path", path), slog.String("error", err.Error()))
+		}
+	}
+	defer flush()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-l.fileC:
+			write(&e)
+		case <-ticker.C:
+			flush()
+			l.mu.Lock()
+			dropped := l.dropped
+			l.dropped = 0
+			l.mu.Unlock()
+			if dropped > 0 {
+				slog.Warn("Dropped query log entries", slog.Uint64("count", dropped))
+			}
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-l.fileC:
+					write(&e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// QueryDNS answers a DNS query like Query, and records the decision in the
+// query log.
+func (c *GslbCore) QueryDNS(q DNSQuery) []netip.Addr {
+	srcIP := q.Resolver
+	if q.ClientSubnet.IsValid() {
+		srcIP = q.ClientSubnet.Addr()
+	}
+
+	ips, d := c.query(q.Service, srcIP, q.Family)
+	if d == nil {
+		return ips
+	}
+
+	e := QueryLogEntry{
+		Time:         c.now(),
+		Service:      d.svc.info.Name,
+		Family:       q.Family,
+		Resolver:     q.Resolver,
+		ClientSubnet: q.ClientSubnet,
+		PopIds:       make([]string, len(d.answers)),
+	}
+	if d.snapshot.Region != nil {
+		e.Region = d.snapshot.Region.Id
+	}
+	for i, popIdx := range d.answers {
+		e.PopIds[i] = c.cfg.Pops[popIdx].Id
+	}
+	c.queryLog.record(e)
+
+	return ips
+}
+
+// RecentQueries returns up to n of the latest DNS decisions, newest first.
+func (c *GslbCore) RecentQueries(n int) []QueryLogEntry {
+	return c.queryLog.recent(n)
+}
+
+// QueryStats returns the counts of the DNS answers since startup.
+func (c *GslbCore) QueryStats() QueryStats {
+	return c.queryLog.statsCopy()
+}
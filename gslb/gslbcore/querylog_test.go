@@ -0,0 +1,172 @@
+package gslbcore_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+)
+
+func TestQueryLog(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.QueryLogSize = 3
+	cfg.QueryLogFile = filepath.Join(t.TempDir(), "queries.jsonl")
+	c := startTestCore(t, cfg)
+
+	queries := []gslbcore.DNSQuery{
+		{Service: "www", Family: gslbcore.IPv4, Resolver: netip.MustParseAddr("203.0.113.53"), ClientSubnet: netip.MustParsePrefix("198.51.100.0/28")},
+		{Service: "www", Family: gslbcore.IPv4, Resolver: netip.MustParseAddr("203.0.113.53"), ClientSubnet: netip.MustParsePrefix("198.51.100.192/28")},
+		{Service: "www", Family: gslbcore.IPv4, Resolver: netip.MustParseAddr("198.51.100.40")},
+		{Service: "www", Family: gslbcore.IPv4, Resolver: netip.MustParseAddr("203.0.113.1")},
+		// Unknown services are not logged.
+		{Service: "foo", Family: gslbcore.IPv4, Resolver: netip.MustParseAddr("203.0.113.1")},
+	}
+	for _, q := range queries {
+		c.QueryDNS(q)
+	}
+	// Neither are queries not over DNS.
+	c.Query("www", netip.MustParseAddr("198.51.100.40"), gslbcore.IPv4)
+
+	recent := c.RecentQueries(10)
+	if len(recent) != 3 {
+		t.Fatalf("RecentQueries: got %d entries, want 3", len(recent))
+	}
+	wantRegions := []string{"", "tokyo", "us-west"}
+	for i, e := range recent {
+		q := queries[3-i]
+		if e.Region != wantRegions[i] || e.Resolver != q.Resolver || e.ClientSubnet != q.ClientSubnet {
+			t.Errorf("RecentQueries[%d]: got %+v, want region %q of %+v", i, e, wantRegions[i], q)
+		}
+		if len(e.PopIds) != 1 {
+			t.Errorf("RecentQueries[%d]: got pops %v, want 1", i, e.PopIds)
+		}
+	}
+	if got := c.RecentQueries(1); len(got) != 1 || got[0].Resolver != recent[0].Resolver {
+		t.Errorf("RecentQueries(1): got %+v, want the newest entry", got)
+	}
+
+	stats := c.QueryStats()
+	if stats.Total != 4 {
+		t.Errorf("Total: got %d, want 4", stats.Total)
+	}
+	usWest := recent[2].PopIds[0]
+	if n := stats.Counts["us-west"][usWest]; n != 2 {
+		t.Errorf("Counts[us-west][%s]: got %d, want 2 in %v", usWest, n, stats.Counts)
+	}
+	if n := stats.Counts[""][recent[0].PopIds[0]]; n != 1 {
+		t.Errorf("Counts[\"\"]: got %d, want 1 in %v", n, stats.Counts)
+	}
+
+	// The file is flushed every second.
+	var lines []gslbcore.QueryLogEntry
+	deadline := time.Now().Add(5 * time.Second)
+	for len(lines) < 4 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+
+		f, err := os.Open(cfg.QueryLogFile)
+		if err != nil {
+			continue
+		}
+		lines = nil
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			var e gslbcore.QueryLogEntry
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+				t.Fatalf("Failed to parse %q: %v", s.Text(), err)
+			}
+			lines = append(lines, e)
+		}
+		f.Close()
+	}
+	if len(lines) != 4 {
+		t.Fatalf("query log file: got %d entries, want 4", len(lines))
+	}
+	if lines[0].ClientSubnet != queries[0].ClientSubnet || lines[0].Region != "us-west" {
+		t.Errorf("query log file: got %+v first, want %+v", lines[0], queries[0])
+	}
+}
+
+func TestQueryLogFileOnShutdown(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.QueryLogFile = filepath.Join(t.TempDir(), "queries.jsonl")
+	c := gslbcore.New(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := make(chan error)
+	go func() { errC <- c.Run(ctx) }()
+	for range 100 {
+		c.QueryDNS(gslbcore.DNSQuery{Service: "www", Family: gslbcore.IPv4, Resolver: netip.MustParseAddr("198.51.100.40")})
+	}
+	cancel()
+	if err := <-errC; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	// The entries queued by the shutdown are written.
+	bs, err := os.ReadFile(cfg.QueryLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(bs, []byte("\n")); n != 100 {
+		t.Errorf("query log file: got %d entries, want 100", n)
+	}
+}
+
+func TestQueryLogFileError(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.QueryLogFile = filepath.Join(t.TempDir(), "missing", "queries.jsonl")
+	c := gslbcore.New(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Run(ctx); err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Run: got %v, want the query log file failing to open", err)
+	}
+}
+
+func TestQueryLogAPI(t *testing.T) {
+	c := gslbcore.New(newTestConfig())
+	h := gslbcore.HTTPHandler(c)
+	for range 3 {
+		c.QueryDNS(gslbcore.DNSQuery{Service: "www", Family: gslbcore.IPv4, Resolver: netip.MustParseAddr("198.51.100.40")})
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/querylog.json?limit=2", nil))
+	var entries []gslbcore.QueryLogEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("querylog.json: %v: %s", err, rec.Body)
+	}
+	if len(entries) != 2 || entries[0].Region != "tokyo" {
+		t.Errorf("querylog.json: got %+v, want 2 entries of tokyo", entries)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/querylog.json?limit=x", nil))
+	if rec.Code != 400 {
+		t.Errorf("querylog.json?limit=x: got %d, want 400", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/querystats.json", nil))
+	var stats gslbcore.QueryStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("querystats.json: %v: %s", err, rec.Body)
+	}
+	var n uint64
+	for _, count := range stats.Counts["tokyo"] {
+		n += count
+	}
+	if stats.Total != 3 || n != 3 {
+		t.Errorf("querystats.json: got %+v, want 3 queries of tokyo", stats)
+	}
+}
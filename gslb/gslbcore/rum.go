@@ -0,0 +1,227 @@
+package gslbcore
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/yzp0n/ncdn/types"
+)
+
+// Up to this many RUM samples are kept per region and PoP.
+const maxRUMSamples = 1000
+
+// Beacons claiming latency beyond this are rejected as bogus.
+const maxRUMLatency = 60_000 // ms
+
+// Up to this many clients are remembered as having sent a beacon within the
+// window. Beacons of more clients are rejected.
+const maxRUMSources = 100_000
+
+var errRUMDisabled = errors.New("RUM is disabled")
+var errRUMRateLimited = errors.New("Too many beacons from the client")
+
+type rumSample struct {
+	at      time.Time
+	latency float64
+}
+
+// rumSource is a client, i.e. an IPv4 address or an IPv6 /64, reporting on
+// a PoP.
+type rumSource struct {
+	prefix netip.Prefix
+	popIdx int
+}
+
+func newRUMSource(ip netip.Addr, popIdx int) rumSource {
+	bits := 32
+	if ip.Is6() {
+		bits = 64
+	}
+	prefix, _ := ip.Prefix(bits)
+	return rumSource{prefix: prefix, popIdx: popIdx}
+}
+
+// rumState keeps the latency observed by real users of each region to
+// each PoP.
+type rumState struct {
+	window time.Duration
+
+	// The phase of the page loads taken as the latency, by region, matching
+	// the probes of the region.
+	phases []ProbePhase
+
+	mu sync.Mutex
+	// samples[i][j] is of the i-th region to the j-th PoP, oldest first.
+	samples [][][]rumSample
+	// The time each source last had a sample taken.
+	seen map[rumSource]time.Time
+}
+
+func newRUMState(cfg *Config) *rumState {
+	s := &rumState{
+		window:  cmp.Or(cfg.RUMWindow, 10*time.Minute),
+		phases:  make([]ProbePhase, len(cfg.Regions)),
+		samples: make([][][]rumSample, len(cfg.Regions)),
+		seen:    make(map[rumSource]time.Time),
+	}
+	for i, r := range cfg.Regions {
+		phase, err := ParseProbePhase(r.LatencyPhase)
+		if err != nil {
+			phase = PhaseFirstByte
+		}
+		s.phases[i] = phase
+		s.samples[i] = make([][]rumSample, len(cfg.Pops))
+	}
+	return s
+}
+
+// add takes a sample of the client, unless it had one taken for the PoP
+// within the window already, so that a single client can't outweigh the
+// others.
+func (s *rumState) add(regionIdx, popIdx int, client netip.Addr, latency float64, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src := newRUMSource(client, popIdx)
+	if at, ok := s.seen[src]; ok && now.Sub(at) < s.window {
+		return errRUMRateLimited
+	}
+	if len(s.seen) >= maxRUMSources {
+		maps.DeleteFunc(s.seen, func(_ rumSource, at time.Time) bool {
+			return now.Sub(at) >= s.window
+		})
+		if len(s.seen) >= maxRUMSources {
+			return errRUMRateLimited
+		}
+	}
+	s.seen[src] = now
+
+	samples := append(s.samples[regionIdx][popIdx], rumSample{at: now, latency: latency})
+	if len(samples) > maxRUMSamples {
+		samples = slices.Delete(samples, 0, len(samples)-maxRUMSamples)
+	}
+	s.samples[regionIdx][popIdx] = samples
+	return nil
+}
+
+// latency returns the median of the samples within the window, and their
+// number. The older samples are dropped.
+func (s *rumState) latency(regionIdx, popIdx int, now time.Time) (float64, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	samples := s.samples[regionIdx][popIdx]
+	first, _ := slices.BinarySearchFunc(samples, now.Add(-s.window), func(s rumSample, t time.Time) int {
+		return s.at.Compare(t)
+	})
+	samples = slices.Delete(samples, 0, first)
+	s.samples[regionIdx][popIdx] = samples
+
+	if len(samples) == 0 {
+		return 0, 0
+	}
+	values := make([]float64, len(samples))
+	for i, sample := range samples {
+		values[i] = sample.latency
+	}
+	return aggregateSamples(values, 0), len(values)
+}
+
+// ReportRUM records the latency of a page load reported by a real user,
+// sending the beacon from remoteIP. Beacons of clients not in any region,
+// and of page loads over reused connections, which took no time to connect,
+// are ignored. Each client has at most one beacon per PoP taken within the
+// RUM window.
+func (c *GslbCore) ReportRUM(b *types.RUMBeacon, remoteIP netip.Addr) error {
+	if c.rum == nil {
+		return errRUMDisabled
+	}
+
+	popIdx := slices.IndexFunc(c.cfg.Pops, func(p types.PoPInfo) bool { return p.Id == b.PopId })
+	if popIdx == -1 {
+		return fmt.Errorf("Unknown pop %q", b.PopId)
+	}
+
+	clientIP := remoteIP.Unmap()
+
+	c.mu.Lock()
+	regionIdx, _ := c.findRegionLocked(clientIP)
+	c.mu.Unlock()
+	if regionIdx == -1 || b.ConnectEnd == b.ConnectStart {
+		return nil
+	}
+
+	// The timings of the browser map to those of the probers, except that
+	// the request is only known to start.
+	res := types.ProbeResult{
+		Start:       b.FetchStart * 1e6,
+		DNSEnd:      b.DomainLookupEnd * 1e6,
+		ConnectEnd:  b.ConnectEnd * 1e6,
+		RequestEnd:  b.RequestStart * 1e6,
+		FirstByte:   b.ResponseStart * 1e6,
+		ResponseEnd: b.ResponseEnd * 1e6,
+	}
+	latency, err := c.rum.phases[regionIdx].Measure(&res)
+	if err != nil {
+		return err
+	}
+	if latency > maxRUMLatency {
+		return fmt.Errorf("Latency=%vms is out of range", latency)
+	}
+
+	slog.Debug("RUM beacon",
+		slog.String("region.Id", c.cfg.Regions[regionIdx].Id),
+		slog.String("pop.Id", b.PopId),
+		slog.Float64("latency", latency))
+	return c.rum.add(regionIdx, popIdx, clientIP, latency, c.now())
+}
+
+// rumLatency returns the latency observed by real users of the region to
+// the PoP of the latency endpoint, and the number of samples.
+func (c *GslbCore) rumLatency(regionIdx int, endpointUrl string) (float64, int) {
+	popIdx := slices.IndexFunc(c.cfg.Pops, func(p types.PoPInfo) bool { return p.LatencyEndpointUrl == endpointUrl })
+	if popIdx == -1 {
+		return 0, 0
+	}
+	return c.rum.latency(regionIdx, popIdx, c.now())
+}
+
+// BlendedMeasurer blends the latency measured by a prober with the one
+// observed by real users of the region, so that the routing reflects the
+// users rather than the single vantage point of the prober.
+type BlendedMeasurer struct {
+	Prober LatencyMeasurer
+
+	// Returns the latency observed by real users to the PoP of the endpoint,
+	// and the number of samples it is of.
+	RUMLatency func(endpointUrl string) (latency float64, samples int)
+
+	// The weight of the RUM latency in (0, 1], once there are MinSamples.
+	Weight     float64
+	MinSamples int
+}
+
+func (m *BlendedMeasurer) DebugString() string {
+	return fmt.Sprintf("BlendedMeasurer{Prober=%s, Weight=%v}", m.Prober.DebugString(), m.Weight)
+}
+
+func (m *BlendedMeasurer) MeasureLatency(ctx context.Context, endpointUrl string) (float64, error) {
+	rum, n := m.RUMLatency(endpointUrl)
+	lat, err := m.Prober.MeasureLatency(ctx, endpointUrl)
+	if n < m.MinSamples {
+		return lat, err
+	}
+	if err != nil {
+		// Real users keep the PoP measured while the prober is failing.
+		return rum, nil
+	}
+	return m.Weight*rum + (1-m.Weight)*lat, nil
+}
@@ -0,0 +1,165 @@
+package gslbcore_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+	"github.com/yzp0n/ncdn/types"
+)
+
+// newTestBeacon is of a page load from the PoP, of the time to first byte
+// ttfb, with 10ms to connect.
+func newTestBeacon(popId string, ttfb int64) types.RUMBeacon {
+	return types.RUMBeacon{
+		PopId:           popId,
+		FetchStart:      1_700_000_000_000,
+		DomainLookupEnd: 1_700_000_000_000,
+		ConnectStart:    1_700_000_000_000,
+		ConnectEnd:      1_700_000_000_010,
+		RequestStart:    1_700_000_000_010,
+		ResponseStart:   1_700_000_000_000 + ttfb,
+		ResponseEnd:     1_700_000_000_000 + ttfb + 5,
+	}
+}
+
+func TestRUM(t *testing.T) {
+	clock := newTestClock()
+	cfg := newTestConfig()
+	cfg.Now = clock.Now
+	cfg.RUMWeight = 0.5
+	cfg.RUMMinSamples = 3
+	cfg.RUMWindow = 10 * time.Minute
+	c := gslbcore.New(cfg)
+	h := gslbcore.HTTPHandler(c)
+
+	post := func(body, remoteAddr string) int {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/rum", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	postBeacon := func(b types.RUMBeacon, remoteAddr string) int {
+		t.Helper()
+		bs, err := json.Marshal(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return post(string(bs), remoteAddr)
+	}
+
+	// us-west probes 50ms to shibuya, and its users see 30ms.
+	for _, remoteAddr := range []string{"198.51.100.5:50000", "198.51.100.6:50000"} {
+		if code := postBeacon(newTestBeacon("shibuya", 30), remoteAddr); code != http.StatusNoContent {
+			t.Fatalf("POST /rum from %s: got %d, want 204", remoteAddr, code)
+		}
+	}
+	measure := func() float64 {
+		t.Helper()
+		c.UpdateLatency(context.Background())
+		lat, _ := c.RegionLatency("us-west")
+		return lat[1].Value
+	}
+	if got := measure(); got != 50 {
+		t.Errorf("latency with 2 beacons: got %v, want 50 of the prober alone", got)
+	}
+
+	// A client has a single beacon per PoP taken within the window, however
+	// many it sends.
+	if code := postBeacon(newTestBeacon("shibuya", 30), "198.51.100.5:50001"); code != http.StatusTooManyRequests {
+		t.Fatalf("POST /rum again: got %d, want 429", code)
+	}
+	if got := measure(); got != 50 {
+		t.Errorf("latency with a repeated beacon: got %v, want 50 of the prober alone", got)
+	}
+
+	if code := postBeacon(newTestBeacon("shibuya", 30), "198.51.100.7:50000"); code != http.StatusNoContent {
+		t.Fatalf("POST /rum: got %d, want 204", code)
+	}
+	// Ignored, since the connection was reused.
+	reused := newTestBeacon("shibuya", 1000)
+	reused.ConnectEnd = reused.ConnectStart
+	if code := postBeacon(reused, "198.51.100.8:50000"); code != http.StatusNoContent {
+		t.Fatalf("POST /rum: got %d, want 204", code)
+	}
+	// Ignored, since the client is in no region.
+	if code := postBeacon(newTestBeacon("shibuya", 1000), "203.0.113.1:50000"); code != http.StatusNoContent {
+		t.Fatalf("POST /rum: got %d, want 204", code)
+	}
+	// The moving average of 50 and the blended 40.
+	if got, want := measure(), 50*0.7+40*0.3; got != want {
+		t.Errorf("latency with 3 beacons: got %v, want %v", got, want)
+	}
+
+	// Once the window passes, the client is taken again.
+	clock.Advance(cfg.RUMWindow)
+	if code := postBeacon(newTestBeacon("shibuya", 30), "198.51.100.5:50002"); code != http.StatusNoContent {
+		t.Errorf("POST /rum after the window: got %d, want 204", code)
+	}
+
+	for _, tc := range []struct {
+		Name string
+		Body string
+	}{
+		{Name: "unknown-pop", Body: `{"pop_id":"nowhere","fetch_start":1}`},
+		// The client is the sender, whatever the beacon claims.
+		{Name: "forged-client-ip", Body: `{"pop_id":"shibuya","client_ip":"198.51.100.5","connect_end":10,"response_start":30}`},
+		{Name: "bad-json", Body: `{`},
+		{Name: "no-timing", Body: `{"pop_id":"shibuya","connect_end":1}`},
+	} {
+		if code := post(tc.Body, "198.51.100.9:50000"); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", tc.Name, code)
+		}
+	}
+}
+
+func TestRUMDisabled(t *testing.T) {
+	c := gslbcore.New(newTestConfig())
+	b := newTestBeacon("shibuya", 30)
+	if err := c.ReportRUM(&b, netip.MustParseAddr("198.51.100.5")); err == nil {
+		t.Errorf("ReportRUM: got no error with RUM disabled")
+	}
+}
+
+func TestBlendedMeasurer(t *testing.T) {
+	prober := &testLatencyMeasurer{ProberURL: "https://203.0.113.10:8443/probe"}
+	rum := func(samples int) func(string) (float64, int) {
+		return func(string) (float64, int) { return 30, samples }
+	}
+
+	m := &gslbcore.BlendedMeasurer{Prober: prober, RUMLatency: rum(10), Weight: 0.25, MinSamples: 10}
+	if got, err := m.MeasureLatency(context.Background(), "http://192.0.2.2/latencyz"); err != nil || got != 45 {
+		t.Errorf("blended: got %v, %v, want 45", got, err)
+	}
+
+	m.RUMLatency = rum(9)
+	if got, err := m.MeasureLatency(context.Background(), "http://192.0.2.2/latencyz"); err != nil || got != 50 {
+		t.Errorf("too few samples: got %v, %v, want 50 of the prober", got, err)
+	}
+
+	m.Prober = failingMeasurer{}
+	if _, err := m.MeasureLatency(context.Background(), "http://192.0.2.2/latencyz"); err == nil {
+		t.Errorf("prober failing, too few samples: got no error")
+	}
+	m.RUMLatency = rum(10)
+	if got, err := m.MeasureLatency(context.Background(), "http://192.0.2.2/latencyz"); err != nil || got != 30 {
+		t.Errorf("prober failing: got %v, %v, want 30 of the users", got, err)
+	}
+}
+
+type failingMeasurer struct{}
+
+func (failingMeasurer) DebugString() string { return "failingMeasurer" }
+
+func (failingMeasurer) MeasureLatency(ctx context.Context, url string) (float64, error) {
+	return 0, errors.New("prober is down")
+}
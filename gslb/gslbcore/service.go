@@ -0,0 +1,154 @@
+package gslbcore
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/yzp0n/ncdn/types"
+)
+
+// DefaultTtl is the TTL of the answers of services not configuring one.
+const DefaultTtl = 120
+
+// Service is a name answered by the GSLB, served by its own pool of PoPs.
+type Service struct {
+	// The label under the zone, e.g. "www". Matched case-insensitively.
+	Name string
+
+	// The ids of the PoPs serving the service. All PoPs if empty.
+	PopIds []string
+
+	// Defaults to Config.Policy and Config.Answers.
+	Policy  Policy
+	Answers int
+
+	// TTL of the answers in seconds. Defaults to DefaultTtl.
+	Ttl uint32
+
+	// If set, the URL is fetched from each PoP of the pool every status
+	// round, with "{addr}" replaced by the address of the PoP. PoPs not
+	// responding with a 2xx status aren't answered for the service.
+	HealthCheckUrl string
+}
+
+// CheckHealthFunc checks the health of a service at the url.
+type CheckHealthFunc func(ctx context.Context, url string) error
+
+type serviceState struct {
+	info    Service
+	policy  Policy
+	answers int
+
+	// Whether each PoP is in the pool of the service.
+	inPool []bool
+
+	// The error of the last health check of each PoP, or "" if it passed
+	// or isn't checked. Guarded by GslbCore.mu, and replaced, not modified,
+	// on updates.
+	checkErr []string
+}
+
+// newServiceStates returns the states of the services of cfg, or of a
+// single "www" service of all PoPs if none is configured.
+func newServiceStates(cfg *Config, defaultPolicy Policy) []*serviceState {
+	services := cfg.Services
+	if len(services) == 0 {
+		services = []Service{{Name: "www"}}
+	}
+
+	states := make([]*serviceState, len(services))
+	for i, svc := range services {
+		svc.Name = strings.ToLower(svc.Name)
+		svc.Ttl = cmp.Or(svc.Ttl, DefaultTtl)
+
+		policy := svc.Policy
+		if policy == nil {
+			policy = defaultPolicy
+		}
+		s := &serviceState{
+			info:     svc,
+			policy:   policy,
+			answers:  cmp.Or(svc.Answers, cfg.Answers, 1),
+			inPool:   make([]bool, len(cfg.Pops)),
+			checkErr: make([]string, len(cfg.Pops)),
+		}
+		for j, pop := range cfg.Pops {
+			s.inPool[j] = len(svc.PopIds) == 0 || slices.Contains(svc.PopIds, pop.Id)
+			if s.inPool[j] && svc.HealthCheckUrl != "" {
+				s.checkErr[j] = "not yet available"
+			}
+		}
+		states[i] = s
+	}
+	return states
+}
+
+// serves returns whether any PoP of the pool has an address in the family.
+func (s *serviceState) serves(pops []types.PoPInfo, family Family) bool {
+	for i, pop := range pops {
+		if s.inPool[i] && family.Has(pop) {
+			return true
+		}
+	}
+	return false
+}
+
+// service returns the state of the service of the name, or nil.
+func (c *GslbCore) service(name string) *serviceState {
+	name = strings.ToLower(name)
+	for _, s := range c.services {
+		if s.info.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Service returns the configuration of the service of the name, with its
+// defaults filled in.
+func (c *GslbCore) Service(name string) (Service, bool) {
+	s := c.service(name)
+	if s == nil {
+		return Service{}, false
+	}
+	svc := s.info
+	svc.Policy = s.policy
+	svc.Answers = s.answers
+	return svc, true
+}
+
+// checkServiceHealthOnce runs the health check of the service at the i-th
+// PoP.
+func (c *GslbCore) checkServiceHealthOnce(ctx context.Context, s *serviceState, i int) error {
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(c.cfg.StatusTimeout, 5*time.Second))
+	defer cancel()
+
+	addr := AnyFamily.Addr(c.cfg.Pops[i]).String()
+	if strings.Contains(addr, ":") {
+		addr = "[" + addr + "]"
+	}
+	url := strings.ReplaceAll(s.info.HealthCheckUrl, "{addr}", addr)
+
+	start := time.Now()
+	err := c.checkHealth(ctx, url)
+	c.observeProbe(ProbeResult{
+		Kind:    ProbeHealthCheck,
+		PopId:   c.cfg.Pops[i].Id,
+		Service: s.info.Name,
+		Took:    time.Since(start),
+		Err:     err,
+	})
+	if err != nil {
+		slog.Error("Service health check failed",
+			slog.String("service", s.info.Name),
+			slog.String("pop.Id", c.cfg.Pops[i].Id),
+			slog.String("error", err.Error()))
+		return fmt.Errorf("Health check of %s failed: %w", url, err)
+	}
+	return nil
+}
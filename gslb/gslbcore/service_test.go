@@ -0,0 +1,91 @@
+package gslbcore_test
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+)
+
+func TestServices(t *testing.T) {
+	var mu sync.Mutex
+	checked := make(map[string]bool)
+	failing := map[string]bool{"http://192.0.2.2/healthz": true}
+
+	cfg := newTestConfig()
+	cfg.Services = []gslbcore.Service{
+		{Name: "www"},
+		{Name: "IMG", PopIds: []string{"shinjuku", "akiba"}, Answers: 2, Ttl: 300},
+		{
+			Name:           "api",
+			PopIds:         []string{"shibuya", "shinjuku"},
+			Policy:         gslbcore.NearestPolicy{},
+			HealthCheckUrl: "http://{addr}/healthz",
+		},
+	}
+	cfg.CheckHealth = func(ctx context.Context, url string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		checked[url] = true
+		if failing[url] {
+			return errors.New("unhealthy")
+		}
+		return nil
+	}
+	c := startTestCore(t, cfg)
+
+	srcIP := netip.MustParseAddr("198.51.100.12") // us-west
+	query := func(service string) []string {
+		t.Helper()
+		var ret []string
+		for _, ip := range c.Query(service, srcIP, gslbcore.IPv4) {
+			ret = append(ret, ip.String())
+		}
+		return ret
+	}
+
+	// us-west: shibuya (50ms), akiba (80ms), shinjuku (100ms). atlantis is down.
+	testcases := []struct {
+		Service string
+		Want    []string
+	}{
+		{"www", []string{"192.0.2.2"}},
+		{"img", []string{"192.0.2.3", "192.0.2.1"}},
+		{"Img", []string{"192.0.2.3", "192.0.2.1"}},
+		// shibuya fails the health check of api.
+		{"api", []string{"192.0.2.1"}},
+		{"cdn", nil},
+	}
+	for _, tc := range testcases {
+		if got := query(tc.Service); !slices.Equal(got, tc.Want) {
+			t.Errorf("Query(%s): got %v, want %v", tc.Service, got, tc.Want)
+		}
+	}
+
+	mu.Lock()
+	wantChecked := map[string]bool{"http://192.0.2.1/healthz": true, "http://192.0.2.2/healthz": true}
+	if len(checked) != len(wantChecked) || !checked["http://192.0.2.1/healthz"] || !checked["http://192.0.2.2/healthz"] {
+		t.Errorf("health checks: got %v, want %v", checked, wantChecked)
+	}
+	// Once the whole pool fails, it is answered fail-open.
+	failing["http://192.0.2.1/healthz"] = true
+	mu.Unlock()
+	c.UpdatePoPStatus(context.Background())
+	if got, want := query("api"), []string{"192.0.2.2"}; !slices.Equal(got, want) {
+		t.Errorf("Query(api) with the pool failing: got %v, want %v", got, want)
+	}
+
+	if svc, ok := c.Service("img"); !ok || svc.Ttl != 300 || svc.Answers != 2 {
+		t.Errorf("Service(img): got %+v, %v", svc, ok)
+	}
+	if svc, ok := c.Service("www"); !ok || svc.Ttl != gslbcore.DefaultTtl || svc.Answers != 1 {
+		t.Errorf("Service(www): got %+v, %v", svc, ok)
+	}
+	if _, ok := c.Service("cdn"); ok {
+		t.Errorf("Service(cdn): expected not found")
+	}
+}
@@ -0,0 +1,214 @@
+package gslbcore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/yzp0n/ncdn/types"
+)
+
+// savedState is the measurement state written to Config.StateFile, along
+// with the overrides of the PoPs. PoPs and regions are keyed by their ids,
+// so that the file survives changes to the configuration.
+type savedState struct {
+	SavedAt   time.Time                   `json:"saved_at"`
+	Pops      map[string]*types.PoPStatus `json:"pops"`
+	Regions   map[string]savedRegion      `json:"regions"`
+	Overrides map[string]Override         `json:"overrides,omitempty"`
+}
+
+type savedRegion struct {
+	Preferred string             `json:"preferred,omitempty"`
+	Latency   map[string]Latency `json:"latency"`
+}
+
+// snapshotState returns the current measurements and overrides.
+func (c *GslbCore) snapshotState() *savedState {
+	st := &savedState{
+		SavedAt: c.now(),
+		Pops:    make(map[string]*types.PoPStatus),
+		Regions: make(map[string]savedRegion),
+	}
+
+	c.mu.Lock()
+	for i, ps := range c.popstate {
+		st.Pops[c.cfg.Pops[i].Id] = ps
+	}
+	for _, r := range c.regions {
+		sr := savedRegion{Latency: make(map[string]Latency)}
+		for i, lat := range r.popLatency {
+			sr.Latency[c.cfg.Pops[i].Id] = lat
+		}
+		if r.preferred != -1 {
+			sr.Preferred = c.cfg.Pops[r.preferred].Id
+		}
+		st.Regions[r.info.Id] = sr
+	}
+	st.Overrides = c.overridesLocked(st.SavedAt)
+	c.mu.Unlock()
+	return st
+}
+
+// SaveState writes the current measurements to Config.StateFile.
+func (c *GslbCore) SaveState() error {
+	bs, err := json.MarshalIndent(c.snapshotState(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal state: %v", err)
+	}
+
+	// Write to a temporary file first, so that a crash never leaves a
+	// truncated state behind.
+	path := c.cfg.StateFile
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(bs); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// restoreState loads the measurements saved in Config.StateFile, unless they
+// are older than Config.StateMaxAge. The overrides are restored regardless
+// until they expire, since they are what the operator asked for rather
+// than measurements. It is called before c is shared.
+func (c *GslbCore) restoreState(maxAge time.Duration) error {
+	bs, err := os.ReadFile(c.cfg.StateFile)
+	if err != nil {
+		return err
+	}
+	var st savedState
+	if err := json.Unmarshal(bs, &st); err != nil {
+		return fmt.Errorf("Failed to parse %s: %v", c.cfg.StateFile, err)
+	}
+
+	c.applyOverrides(&st)
+	if age := c.now().Sub(st.SavedAt); age > maxAge {
+		return fmt.Errorf("State saved at %s is too old", st.SavedAt.Format(time.RFC3339))
+	}
+	c.applyMeasurements(&st)
+
+	slog.Info("Restored the GSLB state",
+		slog.String("path", c.cfg.StateFile),
+		slog.Time("savedAt", st.SavedAt))
+	return nil
+}
+
+// CarryOver takes over the measurements and overrides of the PoPs and
+// regions of prev whose ids are unchanged, e.g. when the configuration is
+// reloaded. The health check results of the services, and the flap damping
+// of the PoPs, which aren't saved to the state file, are taken over as well.
+// It must be called before c is shared.
+func (c *GslbCore) CarryOver(prev *GslbCore) {
+	st := prev.snapshotState()
+	c.applyOverrides(st)
+	c.applyMeasurements(st)
+	c.carryOverHealth(prev)
+
+	// Keep the SOA serial increasing across reloads.
+	c.serial = prev.Serial() + 1
+
+	slog.Info("Carried over the GSLB state",
+		slog.Int("pops", len(st.Pops)),
+		slog.Int("regions", len(st.Regions)))
+}
+
+// carryOverHealth takes over the health check results of prev by service
+// name and PoP id, and its flap dampers by PoP id.
+func (c *GslbCore) carryOverHealth(prev *GslbCore) {
+	prevPop := make(map[string]int)
+	for i, pop := range prev.cfg.Pops {
+		prevPop[pop.Id] = i
+	}
+
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+
+	for _, s := range c.services {
+		ps := prev.service(s.info.Name)
+		if s.info.HealthCheckUrl == "" || ps == nil || ps.info.HealthCheckUrl == "" {
+			continue
+		}
+		for i, pop := range c.cfg.Pops {
+			if j, ok := prevPop[pop.Id]; ok && s.inPool[i] && ps.inPool[j] {
+				s.checkErr[i] = ps.checkErr[j]
+			}
+		}
+	}
+
+	for i, pop := range c.cfg.Pops {
+		j, ok := prevPop[pop.Id]
+		if !ok {
+			continue
+		}
+		// The thresholds are of the new configuration.
+		pd, d := &prev.flapDampers[j], &c.flapDampers[i]
+		d.observed = pd.observed
+		d.healthy = pd.healthy
+		d.turns = slices.Clone(pd.turns)
+		d.holdDownUntil = pd.holdDownUntil
+	}
+}
+
+// applyOverrides takes over the overrides of st which haven't expired.
+func (c *GslbCore) applyOverrides(st *savedState) {
+	now := c.now()
+	for i, pop := range c.cfg.Pops {
+		if o, ok := st.Overrides[pop.Id]; ok && o.validate() == nil && o.activeAt(now) {
+			c.overrides[i] = o
+		}
+	}
+}
+
+// applyMeasurements takes over the measurements of st.
+func (c *GslbCore) applyMeasurements(st *savedState) {
+	for i, pop := range c.cfg.Pops {
+		if ps, ok := st.Pops[pop.Id]; ok && ps != nil {
+			c.popstate[i] = ps
+		}
+	}
+	for _, r := range c.regions {
+		sr, ok := st.Regions[r.info.Id]
+		if !ok {
+			continue
+		}
+		for i, pop := range c.cfg.Pops {
+			if lat, ok := sr.Latency[pop.Id]; ok {
+				r.popLatency[i] = lat
+				r.estimators[i].estimate = lat
+			}
+			if pop.Id == sr.Preferred {
+				r.preferred = i
+			}
+		}
+	}
+}
+
+// runStateSave saves the state every interval, and once more when ctx is done.
+func (c *GslbCore) runStateSave(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-c.after(interval):
+		case <-ctx.Done():
+		}
+
+		if err := c.SaveState(); err != nil {
+			slog.Error("Failed to save the GSLB state", slog.String("error", err.Error()))
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package gslbcore_test
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+	"github.com/yzp0n/ncdn/types"
+)
+
+func TestRestoreState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gslb-state.json")
+
+	cfg := newTestConfig()
+	cfg.StateFile = path
+	c := startTestCore(t, cfg)
+	if err := c.SaveState(); err != nil {
+		t.Fatalf("SaveState: %v", err)
+	}
+
+	testcases := []struct {
+		Name   string
+		MaxAge time.Duration
+		// Answers for a us-west and a us-east client right after New.
+		Want []string
+	}{
+		{
+			Name:   "restored",
+			MaxAge: time.Hour,
+			Want:   []string{"192.0.2.2", "192.0.2.1"},
+		},
+		{
+			// Without the state, all PoPs are equally unknown.
+			Name:   "too-old",
+			MaxAge: time.Nanosecond,
+			Want:   []string{"192.0.2.1", "192.0.2.1"},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			cfg := newTestConfig()
+			cfg.StateFile = path
+			cfg.StateMaxAge = tc.MaxAge
+			cfg.Policy = gslbcore.NearestPolicy{}
+			restored := gslbcore.New(cfg)
+
+			for i, ip := range []string{"198.51.100.12", "198.51.100.70"} {
+				rs := restored.Query("www", netip.MustParseAddr(ip), gslbcore.IPv4)
+				if len(rs) != 1 || rs[0].String() != tc.Want[i] {
+					t.Errorf("Query(%s): got %v, want %s", ip, rs, tc.Want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCarryOver(t *testing.T) {
+	// shinjuku fails the health check of api, and akiba turns healthy after
+	// the first round, which holds it down.
+	var akibaDown atomic.Bool
+	akibaDown.Store(true)
+	newConfig := func() *gslbcore.Config {
+		cfg := newTestConfig()
+		cfg.Services = []gslbcore.Service{
+			{Name: "www"},
+			{Name: "api", PopIds: []string{"shinjuku", "akiba"}, HealthCheckUrl: "http://{addr}/healthz"},
+		}
+		cfg.CheckHealth = func(ctx context.Context, url string) error {
+			if url == "http://192.0.2.1/healthz" {
+				return errors.New("unhealthy")
+			}
+			return nil
+		}
+		fetch := cfg.FetchPoPStatus
+		cfg.FetchPoPStatus = func(ctx context.Context, ip netip.Addr) (*types.PoPStatus, error) {
+			if ip == netip.MustParseAddr("192.0.2.3") && akibaDown.Load() {
+				return nil, errors.New("PoP is down.")
+			}
+			return fetch(ctx, ip)
+		}
+		cfg.FlapThreshold = 1
+		cfg.FlapHoldDown = time.Hour
+		return cfg
+	}
+
+	prev := startTestCore(t, newConfig())
+	if err := prev.SetOverride("akiba", gslbcore.Override{Mode: gslbcore.OverrideDrain}); err != nil {
+		t.Fatal(err)
+	}
+	akibaDown.Store(false)
+	prev.UpdatePoPStatus(context.Background())
+
+	// shibuya is removed, kanda added, and us-east renamed.
+	cfg := newConfig()
+	cfg.Pops = slices.Delete(cfg.Pops, 1, 2)
+	cfg.Pops = append(cfg.Pops, types.PoPInfo{
+		Id:                 "kanda",
+		Ip4:                netip.MustParseAddr("192.0.2.4"),
+		LatencyEndpointUrl: "http://192.0.2.4/latencyz",
+	})
+	cfg.Regions[1].Id = "us-central"
+	cfg.Policy = gslbcore.NearestPolicy{}
+	c := gslbcore.New(cfg)
+	c.CarryOver(prev)
+
+	known := func(lat []gslbcore.Latency) []bool {
+		ret := make([]bool, len(lat))
+		for i, l := range lat {
+			ret[i] = l.Known
+		}
+		return ret
+	}
+	// shinjuku, akiba, atlantis, kanda
+	for _, tc := range []struct {
+		RegionId string
+		Want     []bool
+	}{
+		{"us-west", []bool{true, true, true, false}},
+		{"us-central", []bool{false, false, false, false}},
+	} {
+		lat, ok := c.RegionLatency(tc.RegionId)
+		if !ok {
+			t.Fatalf("RegionLatency(%s): not found", tc.RegionId)
+		}
+		if got := known(lat); !slices.Equal(got, tc.Want) {
+			t.Errorf("RegionLatency(%s): got known %v, want %v", tc.RegionId, got, tc.Want)
+		}
+	}
+	if lat, _ := c.RegionLatency("us-west"); lat[1].Value != 80 {
+		t.Errorf("latency from us-west to akiba: got %v, want 80", lat[1])
+	}
+
+	if o := c.Overrides()["akiba"]; o.Mode != gslbcore.OverrideDrain {
+		t.Errorf("override of akiba: got %+v, want drained", o)
+	}
+	if got, want := c.Serial(), prev.Serial()+1; got != want {
+		t.Errorf("Serial: got %d, want %d", got, want)
+	}
+
+	// akiba is drained, and atlantis down.
+	rs := c.Query("www", netip.MustParseAddr("198.51.100.12"), gslbcore.IPv4)
+	if len(rs) != 1 || rs[0].String() != "192.0.2.1" {
+		t.Errorf("Query: got %v, want 192.0.2.1", rs)
+	}
+
+	candidate := func(service, popId string) gslbcore.Candidate {
+		t.Helper()
+		e, err := c.Explain(service, netip.MustParseAddr("198.51.100.12"), gslbcore.IPv4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cand := range e.Candidates {
+			if cand.PopId == popId {
+				return cand
+			}
+		}
+		t.Fatalf("Explain(%s): no candidate %s", service, popId)
+		return gslbcore.Candidate{}
+	}
+	if got := candidate("api", "shinjuku").HealthCheckError; !strings.HasSuffix(got, ": unhealthy") {
+		t.Errorf("health check of shinjuku for api: got %q, want the failure of prev", got)
+	}
+	// akiba is still held down once measured by c.
+	c.UpdatePoPStatus(context.Background())
+	if got := candidate("www", "akiba").Error; !strings.HasPrefix(got, "held down") {
+		t.Errorf("status of akiba: got %q, want held down", got)
+	}
+}
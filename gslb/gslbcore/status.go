@@ -0,0 +1,81 @@
+package gslbcore
+
+import (
+	"time"
+)
+
+// ProbeKind is the kind of a measurement taken of a PoP.
+type ProbeKind string
+
+const (
+	ProbeStatus      ProbeKind = "status"
+	ProbeLatency     ProbeKind = "latency"
+	ProbeHealthCheck ProbeKind = "health_check"
+)
+
+// ProbeResult is the outcome of a single measurement, as reported to
+// Config.ObserveProbe.
+type ProbeResult struct {
+	Kind  ProbeKind
+	PopId string
+
+	// [latency] The region the PoP was probed from.
+	RegionId string
+	// [health_check] The service the PoP was checked for.
+	Service string
+
+	Took time.Duration
+	Err  error
+}
+
+type ObserveProbeFunc func(ProbeResult)
+
+// PoPHealth is the status of a PoP as seen by the queries.
+type PoPHealth struct {
+	PopId string
+
+	// Whether the PoP is answerable, disregarding the health checks of the
+	// services. Drained and disabled PoPs are not.
+	Healthy bool
+
+	Load        float64
+	Utilization float64
+}
+
+// Status is a snapshot of the measurements, e.g. to be exported as metrics.
+type Status struct {
+	Pops []PoPHealth
+
+	// The known latency from each region to each PoP, keyed by their ids.
+	Latency map[string]map[string]float64
+}
+
+// Status returns the current measurements.
+func (c *GslbCore) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	healthy, failOpen := c.healthyLocked(nil, AnyFamily)
+	s := &Snapshot{Pops: c.cfg.Pops, PoPStatus: c.popstate}
+
+	st := Status{Latency: make(map[string]map[string]float64)}
+	for i, pop := range c.cfg.Pops {
+		st.Pops = append(st.Pops, PoPHealth{
+			PopId: pop.Id,
+			// Answering all PoPs when none is healthy doesn't make them so.
+			Healthy:     healthy[i] && !failOpen,
+			Load:        c.popstate[i].Load,
+			Utilization: s.Utilization(i),
+		})
+	}
+	for _, r := range c.regions {
+		m := make(map[string]float64)
+		for i, lat := range r.popLatency {
+			if lat.Known {
+				m[c.cfg.Pops[i].Id] = lat.Value
+			}
+		}
+		st.Latency[r.info.Id] = m
+	}
+	return st
+}
@@ -0,0 +1,65 @@
+package gslbcore_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/yzp0n/ncdn/gslb/gslbcore"
+)
+
+func TestStatus(t *testing.T) {
+	cfg := newTestConfig()
+	var mu sync.Mutex
+	probes := make(map[gslbcore.ProbeKind]map[string]int) // kind → "region/pop/result"
+	cfg.ObserveProbe = func(res gslbcore.ProbeResult) {
+		key := res.RegionId + "/" + res.PopId + "/ok"
+		if res.Err != nil {
+			key = res.RegionId + "/" + res.PopId + "/failed"
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if probes[res.Kind] == nil {
+			probes[res.Kind] = make(map[string]int)
+		}
+		probes[res.Kind][key]++
+	}
+	c := startTestCore(t, cfg)
+
+	st := c.Status()
+	if len(st.Pops) != len(cfg.Pops) {
+		t.Fatalf("Pops: got %d, want %d", len(st.Pops), len(cfg.Pops))
+	}
+	for _, pop := range st.Pops {
+		wantHealthy := pop.PopId != "atlantis"
+		if pop.Healthy != wantHealthy {
+			t.Errorf("Pops[%s].Healthy: got %v, want %v", pop.PopId, pop.Healthy, wantHealthy)
+		}
+	}
+	if got := st.Pops[1].Load; got != 2 {
+		t.Errorf("Pops[shibuya].Load: got %v, want 2", got)
+	}
+	if got := st.Latency["us-west"]["shibuya"]; got != 50 {
+		t.Errorf("Latency[us-west][shibuya]: got %v, want 50", got)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if probes[gslbcore.ProbeStatus]["/shinjuku/ok"] == 0 || probes[gslbcore.ProbeStatus]["/atlantis/failed"] == 0 {
+		t.Errorf("status probes: got %v", probes[gslbcore.ProbeStatus])
+	}
+	if probes[gslbcore.ProbeLatency]["us-west/shibuya/ok"] == 0 {
+		t.Errorf("latency probes: got %v", probes[gslbcore.ProbeLatency])
+	}
+}
+
+func TestStatusAllDown(t *testing.T) {
+	c := gslbcore.New(newTestConfig())
+
+	// No status is fetched yet, so all PoPs are answered fail-open, but none
+	// is healthy.
+	for _, pop := range c.Status().Pops {
+		if pop.Healthy {
+			t.Errorf("Pops[%s].Healthy: got true, want false", pop.PopId)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+//go:build ignore
+
+// gen_mmdb writes regions.mmdb, a tiny MaxMind DB used by the tests of the
+// mmdb prefix source. Run with `go run testdata/gen_mmdb.go` in gslbcore.
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/netip"
+	"os"
+)
+
+type record struct {
+	country string
+	asn     uint32
+}
+
+var networks = []struct {
+	prefix string
+	record record
+}{
+	{"192.0.2.0/25", record{"JP", 64500}},
+	{"192.0.2.128/25", record{"JP", 64501}},
+	{"198.51.100.0/24", record{"US", 64502}},
+	{"2001:db8::/33", record{"JP", 64500}},
+	{"2001:db8:8000::/33", record{"DE", 64503}},
+}
+
+// node records are either a node index, empty, or a data index.
+type nodeRecord struct {
+	kind  int // 0: empty, 1: node, 2: data
+	value int
+}
+
+type node struct {
+	records [2]nodeRecord
+}
+
+func bitAt(b [16]byte, i int) int {
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+func encodeString(buf *bytes.Buffer, s string) {
+	buf.WriteByte(2<<5 | byte(len(s)))
+	buf.WriteString(s)
+}
+
+func encodeUint(buf *bytes.Buffer, typ byte, n uint64) {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	buf.WriteByte(typ<<5 | byte(len(b)))
+	buf.Write(b)
+}
+
+func encodeMapHeader(buf *bytes.Buffer, n int) {
+	buf.WriteByte(7<<5 | byte(n))
+}
+
+func main() {
+	var data bytes.Buffer
+	var dataOffsets []int
+	for _, n := range networks {
+		dataOffsets = append(dataOffsets, data.Len())
+		encodeMapHeader(&data, 2)
+		encodeString(&data, "country")
+		encodeMapHeader(&data, 1)
+		encodeString(&data, "iso_code")
+		encodeString(&data, n.record.country)
+		encodeString(&data, "autonomous_system_number")
+		encodeUint(&data, 6, uint64(n.record.asn))
+	}
+
+	nodes := []node{{}}
+	// walk returns the node at depth bits-1 on the path of addr, creating
+	// nodes as needed.
+	walk := func(addr [16]byte, bits int) int {
+		cur := 0
+		for i := 0; i < bits-1; i++ {
+			r := &nodes[cur].records[bitAt(addr, i)]
+			if r.kind != 1 {
+				nodes = append(nodes, node{})
+				r = &nodes[cur].records[bitAt(addr, i)]
+				*r = nodeRecord{kind: 1, value: len(nodes) - 1}
+			}
+			cur = r.value
+		}
+		return cur
+	}
+
+	for i, n := range networks {
+		p := netip.MustParsePrefix(n.prefix)
+		addr := p.Addr().As16()
+		bits := p.Bits()
+		if p.Addr().Is4() {
+			// IPv4 networks live under ::/96.
+			addr = netip.AddrFrom4(p.Addr().As4()).As16()
+			addr[10], addr[11] = 0, 0
+			bits += 96
+		}
+		cur := walk(addr, bits)
+		nodes[cur].records[bitAt(addr, bits-1)] = nodeRecord{kind: 2, value: i}
+	}
+
+	// Alias ::ffff:0:0/96 to the IPv4 subtree, like MaxMind databases do.
+	ipv4Start := 0
+	for range 96 {
+		ipv4Start = nodes[ipv4Start].records[0].value
+	}
+	alias := netip.MustParseAddr("::ffff:0:0").As16()
+	cur := walk(alias, 96)
+	nodes[cur].records[1] = nodeRecord{kind: 1, value: ipv4Start}
+
+	var out bytes.Buffer
+	nodeCount := len(nodes)
+	for _, n := range nodes {
+		for _, r := range n.records {
+			v := nodeCount
+			switch r.kind {
+			case 1:
+				v = r.value
+			case 2:
+				v = nodeCount + 16 + dataOffsets[r.value]
+			}
+			out.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	md := []struct {
+		key string
+		typ byte
+		n   uint64
+	}{
+		{"node_count", 6, uint64(nodeCount)},
+		{"record_size", 5, 24},
+		{"ip_version", 5, 6},
+		{"binary_format_major_version", 5, 2},
+		{"binary_format_minor_version", 5, 0},
+	}
+	encodeMapHeader(&out, len(md)+1)
+	for _, m := range md {
+		encodeString(&out, m.key)
+		encodeUint(&out, m.typ, m.n)
+	}
+	encodeString(&out, "database_type")
+	encodeString(&out, "ncdn-test")
+
+	if err := os.WriteFile("testdata/regions.mmdb", out.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -14,6 +14,7 @@ import (
 
 var nodeId = flag.String("nodeId", "unknown_node", "Name of the node")
 var listenAddr = flag.String("listenAddr", ":8888", "Address to listen on")
+var rumBeaconUrl = flag.String("rumBeaconUrl", "", "URL of the /rum endpoint of the GSLB to report the page load timings to. Disabled if empty")
 
 type requestInfo struct {
 		RemoteAddr string
@@ -35,14 +36,19 @@ func serveIndexHTMLInternal(w http.ResponseWriter, r *http.Request) error {
 		return fmt.Errorf("Failed to parse index.html template: %w", err)
 	}
 
-	ri := dumpRequestInfo(r)
+	data := struct {
+		requestInfo
+		RUMBeaconURL string
+	}{dumpRequestInfo(r), *rumBeaconUrl}
 
 	var buf bytes.Buffer
-	if err = tmpl.Execute(&buf, &ri); err != nil {
+	if err = tmpl.Execute(&buf, &data); err != nil {
 		return fmt.Errorf("Failed to execute index.html template: %w", err)
 	}
 
 	w.Header().Set("Content-Type", "text/html")
+	// The page is of the request, and of the PoP it went through.
+	w.Header().Set("Cache-Control", "no-store")
 	_, err = w.Write(buf.Bytes())
 	if err != nil {
 		log.Printf("Failed to write response: %v", err)
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cacheKeyInfo struct {
+	Key      string `json:"key"`
+	Variants int    `json:"variants"`
+	Size     int64  `json:"size"`
+	Hits     int64  `json:"hits"`
+}
+
+type cacheVariantInfo struct {
+	Vary   map[string]string `json:"vary,omitempty"`
+	Status int               `json:"status"`
+	Size   int               `json:"size"`
+	Age    float64           `json:"age"`
+	TTL    float64           `json:"ttl"`
+	Hits   int64             `json:"hits"`
+	Header http.Header       `json:"header"`
+}
+
+type cacheObjectInfo struct {
+	Key      string             `json:"key"`
+	Variants []cacheVariantInfo `json:"variants"`
+}
+
+type cacheStats struct {
+	Objects     int     `json:"objects"`
+	Entries     int     `json:"entries"`
+	Bytes       int64   `json:"bytes"`
+	MaxBytes    int64   `json:"max_bytes"`
+	Hits        int64   `json:"hits"`
+	Misses      int64   `json:"misses"`
+	Bypasses    int64   `json:"bypasses"`
+	Backoffs    int64   `json:"backoffs"`
+	Evictions   int64   `json:"evictions"`
+	HitRatio    float64 `json:"hit_ratio"`
+	BackoffURLs int     `json:"backoff_urls"`
+}
+
+// keys lists cached keys with the prefix, which have a variant with the
+// given status unless status is 0.
+func (c *Cache) keys(prefix string, status int, limit int) []cacheKeyInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var infos []cacheKeyInfo
+	for key, obj := range c.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		info := cacheKeyInfo{Key: key, Variants: len(obj.variants)}
+		matched := status == 0
+		for _, e := range obj.variants {
+			info.Size += int64(len(e.body))
+			info.Hits += e.hits
+			matched = matched || e.status == status
+		}
+		if matched {
+			infos = append(infos, info)
+		}
+	}
+
+	slices.SortFunc(infos, func(a, b cacheKeyInfo) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	if len(infos) > limit {
+		infos = infos[:limit]
+	}
+	return infos
+}
+
+func (c *Cache) object(key string, now time.Time) (*cacheObjectInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	obj, ok := c.objects[key]
+	if !ok {
+		return nil, false
+	}
+
+	info := &cacheObjectInfo{Key: key}
+	for _, e := range obj.variants {
+		vi := cacheVariantInfo{
+			Status: e.status,
+			Size:   len(e.body),
+			Age:    now.Sub(e.storedAt).Seconds(),
+			TTL:    e.expires.Sub(now).Seconds(),
+			Hits:   e.hits,
+			Header: e.header,
+		}
+		if len(obj.vary) > 0 {
+			vi.Vary = make(map[string]string)
+			for i, name := range obj.vary {
+				vi.Vary[name] = e.varyValues[i]
+			}
+		}
+		info.Variants = append(info.Variants, vi)
+	}
+	return info, true
+}
+
+// Delete removes all variants of the key, and returns whether there were any.
+func (c *Cache) Delete(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	obj, ok := c.objects[key]
+	if !ok {
+		return false
+	}
+	for _, e := range obj.variants {
+		c.removeLocked(e)
+	}
+	return true
+}
+
+func (c *Cache) stats() cacheStats {
+	s := cacheStats{
+		MaxBytes:    c.cfg.MaxBytes,
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Bypasses:    c.bypasses.Load(),
+		Backoffs:    c.backoffs.Load(),
+		Evictions:   c.evictions.Load(),
+		BackoffURLs: c.backoff.len(),
+	}
+	if total := s.Hits + s.Misses + s.Bypasses + s.Backoffs; total > 0 {
+		s.HitRatio = float64(s.Hits) / float64(total)
+	}
+
+	c.mu.Lock()
+	s.Objects = len(c.objects)
+	s.Entries = c.lru.Len()
+	s.Bytes = c.size
+	c.mu.Unlock()
+
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	bs, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Printf("Failed to marshal admin response: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(bs)
+}
+
+// newAdminHandler returns the handler for the admin port. All requests
+// need to carry `adminToken` as the bearer token.
+func newAdminHandler(cp *CachingProxy, ot *originTransport, warm http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/warmz", warm)
+	mux.HandleFunc("GET /origin", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, ot.statsJSON())
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, cp.cache.stats())
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		status := 0
+		if s := q.Get("status"); s != "" {
+			parsed, err := strconv.Atoi(s)
+			if err != nil {
+				http.Error(w, "Failed to parse status", http.StatusBadRequest)
+				return
+			}
+			status = parsed
+		}
+		limit := 1000
+		if s := q.Get("limit"); s != "" {
+			parsed, err := strconv.Atoi(s)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "Failed to parse limit", http.StatusBadRequest)
+				return
+			}
+			limit = parsed
+		}
+
+		writeJSON(w, cp.cache.keys(q.Get("prefix"), status, limit))
+	})
+	mux.HandleFunc("GET /object", func(w http.ResponseWriter, r *http.Request) {
+		info, ok := cp.cache.object(r.URL.Query().Get("key"), time.Now())
+		if !ok {
+			http.Error(w, "Not cached", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, info)
+	})
+	mux.HandleFunc("DELETE /object", func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if !cp.cache.Delete(key) {
+			http.Error(w, "Not cached", http.StatusNotFound)
+			return
+		}
+		log.Printf("Deleted %q from the cache via admin API", key)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := "Bearer " + *adminToken
+		if *adminToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type backoffState struct {
+	failures int
+	until    time.Time
+}
+
+// originBackoff tracks URLs failing at the origin, so that a broken path
+// isn't retried on every request.
+type originBackoff struct {
+	base time.Duration
+	max  time.Duration
+
+	mu    sync.Mutex
+	state map[string]*backoffState
+}
+
+func newOriginBackoff(base, maxBackoff time.Duration) *originBackoff {
+	return &originBackoff{
+		base: base,
+		max:  maxBackoff,
+
+		state: make(map[string]*backoffState),
+	}
+}
+
+// blocked returns the time until which the origin shouldn't be asked for key.
+func (b *originBackoff) blocked(key string, now time.Time) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.state[key]
+	if !ok || !now.Before(s.until) {
+		return time.Time{}, false
+	}
+	return s.until, true
+}
+
+func (b *originBackoff) fail(key string, now time.Time) {
+	if b.base <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.state[key]
+	if !ok {
+		s = &backoffState{}
+		b.state[key] = s
+	}
+	s.failures++
+
+	d := b.base << min(s.failures-1, 30)
+	if d > b.max || d <= 0 {
+		d = b.max
+	}
+	s.until = now.Add(d)
+}
+
+func (b *originBackoff) succeed(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.state, key)
+}
+
+func (b *originBackoff) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.state)
+}
+
+// purge forgets URLs which haven't failed for a while.
+func (b *originBackoff) purge(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key, s := range b.state {
+		if now.Sub(s.until) > b.max {
+			delete(b.state, key)
+		}
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheStatusHeader is set on every proxied response to tell whether it was
+// served from the cache.
+const cacheStatusHeader = "X-NCDN-Cache"
+
+// Status codes which are cached when the origin response doesn't say otherwise.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+}
+
+// Status codes telling that the resource doesn't exist. These are cached for
+// CacheConfig.NegativeTTL when the origin response doesn't say otherwise.
+var negativeStatus = map[int]bool{
+	http.StatusNotFound: true,
+	http.StatusGone:     true,
+}
+
+type cacheEntry struct {
+	key        string
+	variant    string
+	varyValues []string // request header values selecting the variant, in the order of cacheObject.vary
+
+	status   int
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+	expires  time.Time
+
+	// Fields below are guarded by Cache.mu.
+	hits int64
+	elem *list.Element
+}
+
+// cacheObject holds all variants of a URL, as selected by the origin's Vary header.
+type cacheObject struct {
+	vary     []string
+	variants map[string]*cacheEntry
+}
+
+type CacheConfig struct {
+	// Total size of response bodies kept in the cache.
+	MaxBytes int64
+
+	// Responses larger than this are not cached.
+	MaxObjectBytes int64
+
+	// TTL of cacheable responses without explicit freshness information,
+	// applied only to those with Last-Modified and capped at a tenth of the
+	// time since the modification (RFC 9111 §4.2.2). They are not cached if
+	// zero.
+	DefaultTTL time.Duration
+
+	// TTL of 404/410 responses without explicit freshness information.
+	NegativeTTL time.Duration
+
+	// TTL of 5xx responses. They are not cached if zero.
+	ErrorTTL time.Duration
+
+	// A URL failing at the origin is not retried for OriginBackoff, doubling
+	// on each consecutive failure up to OriginMaxBackoff.
+	OriginBackoff    time.Duration
+	OriginMaxBackoff time.Duration
+}
+
+type Cache struct {
+	cfg CacheConfig
+
+	backoff *originBackoff
+
+	// Closed to stop purging expired entries.
+	done chan struct{}
+
+	// Number of responses by the cacheStatusHeader value, and of entries
+	// evicted to stay within CacheConfig.MaxBytes.
+	hits      atomic.Int64
+	misses    atomic.Int64
+	bypasses  atomic.Int64
+	backoffs  atomic.Int64
+	evictions atomic.Int64
+
+	mu       sync.Mutex
+	objects  map[string]*cacheObject
+	lru      *list.List // of *cacheEntry, most recently used first
+	size     int64
+	inflight map[string]*inflightFill
+}
+
+func NewCache(cfg CacheConfig) *Cache {
+	c := &Cache{
+		cfg: cfg,
+
+		backoff: newOriginBackoff(cfg.OriginBackoff, cfg.OriginMaxBackoff),
+		done:    make(chan struct{}),
+
+		objects:  make(map[string]*cacheObject),
+		lru:      list.New(),
+		inflight: make(map[string]*inflightFill),
+	}
+
+	go func() {
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				c.purgeExpired(now)
+				c.backoff.purge(now)
+			case <-c.done:
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+// Close stops purging expired entries in the background.
+func (c *Cache) Close() {
+	close(c.done)
+}
+
+func cacheKey(r *http.Request) string {
+	return r.URL.RequestURI()
+}
+
+func varyValues(vary []string, h http.Header) []string {
+	vs := make([]string, len(vary))
+	for i, name := range vary {
+		vs[i] = strings.Join(h.Values(name), ",")
+	}
+	return vs
+}
+
+func variantKey(vary []string, h http.Header) string {
+	return strings.Join(varyValues(vary, h), "\x00")
+}
+
+func parseVary(h http.Header) []string {
+	var vary []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			vary = append(vary, http.CanonicalHeaderKey(name))
+		}
+	}
+	slices.Sort(vary)
+	return slices.Compact(vary)
+}
+
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, val, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(val, `"`)
+		}
+	}
+	return cc
+}
+
+// lookup returns a fresh entry matching the request, or nil.
+func (c *Cache) lookup(key string, h http.Header, now time.Time) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	obj, ok := c.objects[key]
+	if !ok {
+		return nil
+	}
+	e, ok := obj.variants[variantKey(obj.vary, h)]
+	if !ok {
+		return nil
+	}
+	if !now.Before(e.expires) {
+		c.removeLocked(e)
+		return nil
+	}
+
+	e.hits++
+	c.lru.MoveToFront(e.elem)
+	return e
+}
+
+func (c *Cache) store(key string, reqHeader http.Header, status int, header http.Header, body []byte, ttl time.Duration) {
+	now := time.Now()
+	vary := parseVary(header)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	obj, ok := c.objects[key]
+	if ok && !slices.Equal(obj.vary, vary) {
+		// The origin changed its mind on Vary. Old variants can't be matched anymore.
+		for _, e := range obj.variants {
+			c.removeLocked(e)
+		}
+		ok = false
+	}
+	if !ok {
+		obj = &cacheObject{
+			vary:     vary,
+			variants: make(map[string]*cacheEntry),
+		}
+		c.objects[key] = obj
+	}
+
+	variant := variantKey(vary, reqHeader)
+	if old, ok := obj.variants[variant]; ok {
+		c.removeLocked(old)
+	}
+
+	e := &cacheEntry{
+		key:        key,
+		variant:    variant,
+		varyValues: varyValues(vary, reqHeader),
+		status:     status,
+		header:     header,
+		body:       body,
+		storedAt:   now,
+		expires:    now.Add(ttl),
+	}
+	e.elem = c.lru.PushFront(e)
+	obj.variants[variant] = e
+	c.size += int64(len(body))
+
+	for c.size > c.cfg.MaxBytes && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back().Value.(*cacheEntry))
+		c.evictions.Add(1)
+	}
+}
+
+func (c *Cache) removeLocked(e *cacheEntry) {
+	obj, ok := c.objects[e.key]
+	if !ok || obj.variants[e.variant] != e {
+		return
+	}
+
+	c.lru.Remove(e.elem)
+	c.size -= int64(len(e.body))
+	delete(obj.variants, e.variant)
+	if len(obj.variants) == 0 {
+		delete(c.objects, e.key)
+	}
+}
+
+func (c *Cache) purgeExpired(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*cacheEntry); !now.Before(e.expires) {
+			c.removeLocked(e)
+		}
+		el = next
+	}
+}
+
+// ttlFor returns how long the response may be cached, or false if it must not be cached.
+func (c *Cache) ttlFor(resp *http.Response) (time.Duration, bool) {
+	if resp.Header.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+	for _, v := range parseVary(resp.Header) {
+		if v == "*" {
+			return 0, false
+		}
+	}
+
+	cc := parseCacheControl(resp.Header)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[d]; ok {
+			return 0, false
+		}
+	}
+
+	heuristicTTL := c.heuristicTTL(resp)
+	switch {
+	case resp.StatusCode >= 500:
+		// Only hold on to errors briefly, no matter what the origin says.
+		return c.cfg.ErrorTTL, c.cfg.ErrorTTL > 0
+	case negativeStatus[resp.StatusCode]:
+		heuristicTTL = c.cfg.NegativeTTL
+	case !cacheableStatus[resp.StatusCode]:
+		return 0, false
+	}
+
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs <= 0 {
+				return 0, false
+			}
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	if v := resp.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0, false
+		}
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		ttl := expires.Sub(date)
+		return ttl, ttl > 0
+	}
+
+	return heuristicTTL, heuristicTTL > 0
+}
+
+// heuristicTTL returns DefaultTTL for responses which were last modified
+// long enough ago, and zero for those without Last-Modified, which are
+// likely to be generated per request.
+func (c *Cache) heuristicTTL(resp *http.Response) time.Duration {
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return 0
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+	return max(min(c.cfg.DefaultTTL, date.Sub(lastModified)/10), 0)
+}
+
+// fillRequestCtx is the context key carrying the fillRequest of a request
+// which missed the cache.
+type fillRequestCtx struct{}
+
+// CachingProxy serves requests from the Cache, and forwards misses to the
+// wrapped ReverseProxy while storing the cacheable responses.
+type CachingProxy struct {
+	cache *Cache
+	proxy *httputil.ReverseProxy
+}
+
+func NewCachingProxy(cache *Cache, proxy *httputil.ReverseProxy) *CachingProxy {
+	p := &CachingProxy{
+		cache: cache,
+		proxy: proxy,
+	}
+	proxy.ModifyResponse = p.modifyResponse
+
+	errorHandler := proxy.ErrorHandler
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// Requests canceled along with their clients don't tell of the origin.
+		if fr, ok := r.Context().Value(fillRequestCtx{}).(*fillRequest); ok && r.Context().Err() == nil {
+			cache.backoff.fail(fr.key, time.Now())
+		}
+
+		if errorHandler != nil {
+			errorHandler(w, r, err)
+			return
+		}
+		log.Printf("Origin request failed: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return p
+}
+
+func isCacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" {
+		return false
+	}
+	if _, ok := parseCacheControl(r.Header)["no-store"]; ok {
+		return false
+	}
+	return true
+}
+
+func (p *CachingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isCacheableRequest(r) {
+		p.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	now := time.Now()
+	key := cacheKey(r)
+	if e := p.cache.lookup(key, r.Header, now); e != nil {
+		p.cache.serveEntry(w, r, e, now)
+		return
+	}
+	if f := p.cache.followFill(key, r.Header); f != nil {
+		if err := p.cache.serveFill(w, r, f); err != nil {
+			log.Printf("Aborting response for %q: %v", key, err)
+			if r.Context().Value(http.ServerContextKey) != nil {
+				panic(http.ErrAbortHandler)
+			}
+		}
+		return
+	}
+
+	if until, ok := p.cache.backoff.blocked(key, now); ok {
+		retryAfter := int(until.Sub(now).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		p.cache.setResult(w.Header(), "BACKOFF")
+		http.Error(w, "Origin is failing for this URL, retrying later.", http.StatusServiceUnavailable)
+		return
+	}
+
+	// The origin request is canceled along with the client, unless other
+	// clients follow its fill by then. See fillRequest.clientGone.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	fr := &fillRequest{key: key, cancel: cancel}
+	context.AfterFunc(r.Context(), fr.clientGone)
+	r = r.WithContext(context.WithValue(ctx, fillRequestCtx{}, fr))
+	p.proxy.ServeHTTP(w, r)
+}
+
+// setResult tells the client how the response was served, and counts it for the stats.
+func (c *Cache) setResult(h http.Header, result string) {
+	switch result {
+	case "HIT", "INFLIGHT":
+		c.hits.Add(1)
+	case "MISS":
+		c.misses.Add(1)
+	case "BYPASS":
+		c.bypasses.Add(1)
+	case "BACKOFF":
+		c.backoffs.Add(1)
+	}
+	h.Set(cacheStatusHeader, result)
+}
+
+func (c *Cache) serveEntry(w http.ResponseWriter, r *http.Request, e *cacheEntry, now time.Time) {
+	h := w.Header()
+	for k, vs := range e.header {
+		h[k] = slices.Clone(vs)
+	}
+	h.Set("Age", strconv.Itoa(int(now.Sub(e.storedAt).Seconds())))
+	c.setResult(h, "HIT")
+	w.WriteHeader(e.status)
+
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(e.body)
+	}
+}
+
+func (p *CachingProxy) modifyResponse(resp *http.Response) error {
+	fr, ok := resp.Request.Context().Value(fillRequestCtx{}).(*fillRequest)
+	if !ok {
+		p.cache.setResult(resp.Header, "BYPASS")
+		return nil
+	}
+	key := fr.key
+
+	if resp.StatusCode >= 500 {
+		p.cache.backoff.fail(key, time.Now())
+	} else {
+		p.cache.backoff.succeed(key)
+	}
+
+	if resp.Request.Method != http.MethodGet {
+		p.cache.setResult(resp.Header, "BYPASS")
+		return nil
+	}
+	ttl, ok := p.cache.ttlFor(resp)
+	if !ok || resp.ContentLength > p.cache.cfg.MaxObjectBytes {
+		p.cache.setResult(resp.Header, "BYPASS")
+		return nil
+	}
+
+	f := newInflightFill(key, resp, ttl)
+	fr.setFill(f)
+	p.cache.startFill(f)
+	p.cache.setResult(resp.Header, "MISS")
+	resp.Body = &fillBody{
+		ReadCloser: resp.Body,
+		cache:      p.cache,
+		fill:       f,
+	}
+	return nil
+}
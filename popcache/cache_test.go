@@ -0,0 +1,703 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yzp0n/ncdn/types"
+)
+
+type testOrigin struct {
+	*httptest.Server
+	numReqs atomic.Int64
+
+	// Requests canceled before the origin responded.
+	numCanceled atomic.Int64
+
+	// Closed to let slow responses complete.
+	release chan struct{}
+}
+
+var largeBody = strings.Repeat("0123456789abcdef", 256)
+
+func serveTestSitemap(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte(`<urlset><url><loc>http://www.ncdn.example/static</loc></url></urlset>`))
+}
+
+func newTestOrigin(t *testing.T) *testOrigin {
+	o := &testOrigin{release: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/static", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("static"))
+	})
+	mux.HandleFunc("/nostore", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write([]byte("nostore"))
+	})
+	mux.HandleFunc("/vary", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		_, _ = w.Write([]byte("lang=" + r.Header.Get("Accept-Language")))
+	})
+	mux.HandleFunc("/dynamic", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("dynamic"))
+	})
+	mux.HandleFunc("/sitemapindex.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<sitemapindex><sitemap><loc>%s</loc></sitemap></sitemapindex>`,
+			html.EscapeString(r.URL.Query().Get("loc")))
+	})
+	mux.HandleFunc("/sitemap.xml", serveTestSitemap)
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Length", "10")
+		_, _ = w.Write([]byte("01234"))
+		http.NewResponseController(w).Flush()
+		<-o.release
+		_, _ = w.Write([]byte("56789"))
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		// Larger than MaxObjectBytes, without telling so upfront.
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte(largeBody[:512]))
+		http.NewResponseController(w).Flush()
+		<-o.release
+		_, _ = w.Write([]byte(largeBody[512:]))
+	})
+	mux.HandleFunc("/stall", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("01234"))
+		http.NewResponseController(w).Flush()
+		select {
+		case <-r.Context().Done():
+			o.numCanceled.Add(1)
+		case <-o.release:
+			_, _ = w.Write([]byte("56789"))
+		}
+	})
+	mux.HandleFunc("/hang", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			o.numCanceled.Add(1)
+		case <-o.release:
+		}
+	})
+	mux.HandleFunc("/truncated", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Length", "10")
+		_, _ = w.Write([]byte("01234"))
+		http.NewResponseController(w).Flush()
+		<-o.release
+		panic(http.ErrAbortHandler)
+	})
+	o.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o.numReqs.Add(1)
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		select {
+		case <-o.release:
+		default:
+			close(o.release)
+		}
+		o.Close()
+	})
+	return o
+}
+
+func newTestCacheConfig() CacheConfig {
+	return CacheConfig{
+		MaxBytes:         1 << 20,
+		MaxObjectBytes:   1 << 10,
+		DefaultTTL:       time.Minute,
+		NegativeTTL:      time.Minute,
+		OriginBackoff:    time.Minute,
+		OriginMaxBackoff: time.Hour,
+	}
+}
+
+func newTestCachingProxy(t *testing.T, o *testOrigin) *CachingProxy {
+	return newTestCachingProxyWithConfig(t, o, newTestCacheConfig())
+}
+
+func newTestCachingProxyWithConfig(t *testing.T, o *testOrigin, cfg CacheConfig) *CachingProxy {
+	originURL, err := url.Parse(o.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewCache(cfg)
+	t.Cleanup(cache.Close)
+	return NewCachingProxy(cache, &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(originURL)
+		},
+	})
+}
+
+func get(t *testing.T, h http.Handler, path string, header http.Header) (string, string) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	bs, err := io.ReadAll(rec.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs), rec.Result().Header.Get(cacheStatusHeader)
+}
+
+func TestCachingProxy(t *testing.T) {
+	o := newTestOrigin(t)
+	cp := newTestCachingProxy(t, o)
+
+	testcases := []struct {
+		Name       string
+		Path       string
+		Header     http.Header
+		WantBody   string
+		WantCache  string
+		WantOrigin int64
+	}{
+		{Name: "static-miss", Path: "/static", WantBody: "static", WantCache: "MISS", WantOrigin: 1},
+		{Name: "static-hit", Path: "/static", WantBody: "static", WantCache: "HIT", WantOrigin: 1},
+		{Name: "nostore-0", Path: "/nostore", WantBody: "nostore", WantCache: "BYPASS", WantOrigin: 2},
+		{Name: "nostore-1", Path: "/nostore", WantBody: "nostore", WantCache: "BYPASS", WantOrigin: 3},
+		{
+			Name:     "vary-ja-miss",
+			Path:     "/vary",
+			Header:   http.Header{"Accept-Language": {"ja"}},
+			WantBody: "lang=ja", WantCache: "MISS", WantOrigin: 4,
+		},
+		{
+			Name:     "vary-en-miss",
+			Path:     "/vary",
+			Header:   http.Header{"Accept-Language": {"en"}},
+			WantBody: "lang=en", WantCache: "MISS", WantOrigin: 5,
+		},
+		{
+			Name:     "vary-ja-hit",
+			Path:     "/vary",
+			Header:   http.Header{"Accept-Language": {"ja"}},
+			WantBody: "lang=ja", WantCache: "HIT", WantOrigin: 5,
+		},
+		{Name: "notfound-miss", Path: "/missing", WantBody: "404 page not found\n", WantCache: "MISS", WantOrigin: 6},
+		{Name: "notfound-hit", Path: "/missing", WantBody: "404 page not found\n", WantCache: "HIT", WantOrigin: 6},
+		{Name: "broken-miss", Path: "/broken", WantBody: "broken\n", WantCache: "BYPASS", WantOrigin: 7},
+		{
+			Name:     "broken-backoff",
+			Path:     "/broken",
+			WantBody: "Origin is failing for this URL, retrying later.\n", WantCache: "BACKOFF", WantOrigin: 7,
+		},
+		// Without Last-Modified, no heuristic TTL applies.
+		{Name: "dynamic-0", Path: "/dynamic", WantBody: "dynamic", WantCache: "BYPASS", WantOrigin: 8},
+		{Name: "dynamic-1", Path: "/dynamic", WantBody: "dynamic", WantCache: "BYPASS", WantOrigin: 9},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			body, cache := get(t, cp, tc.Path, tc.Header)
+			if body != tc.WantBody {
+				t.Errorf("body: got %q, want %q", body, tc.WantBody)
+			}
+			if cache != tc.WantCache {
+				t.Errorf("%s: got %q, want %q", cacheStatusHeader, cache, tc.WantCache)
+			}
+			if n := o.numReqs.Load(); n != tc.WantOrigin {
+				t.Errorf("origin requests: got %d, want %d", n, tc.WantOrigin)
+			}
+		})
+	}
+}
+
+func TestErrorTTL(t *testing.T) {
+	o := newTestOrigin(t)
+	cfg := newTestCacheConfig()
+	cfg.ErrorTTL = time.Minute
+	cfg.OriginBackoff = 0
+	cp := newTestCachingProxyWithConfig(t, o, cfg)
+
+	for i, want := range []string{"MISS", "HIT"} {
+		if body, cache := get(t, cp, "/broken", nil); body != "broken\n" || cache != want {
+			t.Errorf("request %d: got %q %q, want %q %q", i, body, cache, "broken\n", want)
+		}
+	}
+	if n := o.numReqs.Load(); n != 1 {
+		t.Errorf("origin requests within ErrorTTL: got %d, want 1", n)
+	}
+
+	// Let the 5xx expire.
+	cp.cache.mu.Lock()
+	for _, e := range cp.cache.objects["/broken"].variants {
+		e.expires = time.Now()
+	}
+	cp.cache.mu.Unlock()
+
+	if _, cache := get(t, cp, "/broken", nil); cache != "MISS" {
+		t.Errorf("after ErrorTTL: got %q, want MISS", cache)
+	}
+	if n := o.numReqs.Load(); n != 2 {
+		t.Errorf("origin requests after ErrorTTL: got %d, want 2", n)
+	}
+}
+
+func TestWarm(t *testing.T) {
+	o := newTestOrigin(t)
+	cp := newTestCachingProxy(t, o)
+	originURL, _ := url.Parse(o.URL)
+
+	argsBs, _ := json.Marshal(&types.WarmArgs{
+		URLs:        []string{"/static", "http://www.ncdn.example/vary", "/nostore"},
+		Concurrency: 2,
+	})
+	req := httptest.NewRequest(http.MethodPost, "/warmz", bytes.NewReader(argsBs))
+	rec := httptest.NewRecorder()
+	serveWarm(cp, originURL).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status: got %d, want %d", rec.Code, http.StatusOK)
+	}
+	dec := json.NewDecoder(rec.Body)
+	numProgress := 0
+	for dec.More() {
+		var p types.WarmProgress
+		if err := dec.Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("progress: %+v", p)
+		numProgress++
+		if p.Total != 3 || p.Done != numProgress || p.Status != http.StatusOK {
+			t.Errorf("unexpected progress: %+v", p)
+		}
+	}
+	if numProgress != 3 {
+		t.Errorf("progress lines: got %d, want 3", numProgress)
+	}
+
+	if _, cache := get(t, cp, "/static", nil); cache != "HIT" {
+		t.Errorf("/static after warm: got %q, want HIT", cache)
+	}
+	if _, cache := get(t, cp, "/vary", nil); cache != "HIT" {
+		t.Errorf("/vary after warm: got %q, want HIT", cache)
+	}
+}
+
+func TestWarmSitemap(t *testing.T) {
+	o := newTestOrigin(t)
+	cp := newTestCachingProxy(t, o)
+	originURL, _ := url.Parse(o.URL)
+
+	var foreignReqs atomic.Int64
+	foreign := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		foreignReqs.Add(1)
+		serveTestSitemap(w, r)
+	}))
+	defer foreign.Close()
+
+	for _, tc := range []struct {
+		Sitemap string
+		Want    int
+	}{
+		{Sitemap: "/sitemapindex.xml?loc=" + url.QueryEscape(o.URL+"/sitemap.xml"), Want: http.StatusOK},
+		// Sitemaps off the origin are not fetched.
+		{Sitemap: "/sitemapindex.xml?loc=" + url.QueryEscape(foreign.URL+"/sitemap.xml"), Want: http.StatusBadGateway},
+		{Sitemap: foreign.URL + "/sitemap.xml", Want: http.StatusBadGateway},
+	} {
+		argsBs, _ := json.Marshal(&types.WarmArgs{Sitemap: tc.Sitemap})
+		req := httptest.NewRequest(http.MethodPost, "/warmz", bytes.NewReader(argsBs))
+		rec := httptest.NewRecorder()
+		serveWarm(cp, originURL).ServeHTTP(rec, req)
+		if rec.Code != tc.Want {
+			t.Errorf("%s: got %d %s, want %d", tc.Sitemap, rec.Code, rec.Body, tc.Want)
+		}
+	}
+
+	if n := foreignReqs.Load(); n != 0 {
+		t.Errorf("requests off the origin: got %d, want 0", n)
+	}
+
+	if _, cache := get(t, cp, "/static", nil); cache != "HIT" {
+		t.Errorf("/static after warm: got %q, want HIT", cache)
+	}
+}
+
+func TestWarmUnauthorized(t *testing.T) {
+	o := newTestOrigin(t)
+	cp := newTestCachingProxy(t, o)
+	originURL, _ := url.Parse(o.URL)
+
+	*adminToken = "testtoken"
+	defer func() { *adminToken = "" }()
+
+	req := httptest.NewRequest(http.MethodPost, "/warmz", bytes.NewReader([]byte(`{"urls":["/static"]}`)))
+	req.Header.Set("Authorization", "Bearer wrongtoken")
+	rec := httptest.NewRecorder()
+	newAdminHandler(cp, nil, serveWarm(cp, originURL)).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status: got %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if n := o.numReqs.Load(); n != 0 {
+		t.Errorf("origin requests: got %d, want 0", n)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	o := newTestOrigin(t)
+	cp := newTestCachingProxy(t, o)
+	originURL, _ := url.Parse(o.URL)
+
+	*adminToken = "testtoken"
+	defer func() { *adminToken = "" }()
+	admin := newAdminHandler(cp, nil, serveWarm(cp, originURL))
+
+	_, _ = get(t, cp, "/static", nil)
+	_, _ = get(t, cp, "/static", nil)
+	_, _ = get(t, cp, "/vary", http.Header{"Accept-Language": {"ja"}})
+	_, _ = get(t, cp, "/vary", http.Header{"Accept-Language": {"en"}})
+	_, _ = get(t, cp, "/missing", nil)
+
+	call := func(method, target string, v any) int {
+		t.Helper()
+
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer testtoken")
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+
+		if v != nil && rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+				t.Fatalf("%s %s: %v", method, target, err)
+			}
+		}
+		return rec.Code
+	}
+
+	var stats cacheStats
+	call(http.MethodGet, "/stats", &stats)
+	if stats.Objects != 3 || stats.Entries != 4 || stats.Hits != 1 || stats.Misses != 4 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	var keys []cacheKeyInfo
+	call(http.MethodGet, "/keys?status=404", &keys)
+	if len(keys) != 1 || keys[0].Key != "/missing" {
+		t.Errorf("unexpected keys with status=404: %+v", keys)
+	}
+	call(http.MethodGet, "/keys?prefix=/v", &keys)
+	if len(keys) != 1 || keys[0].Key != "/vary" || keys[0].Variants != 2 {
+		t.Errorf("unexpected keys with prefix=/v: %+v", keys)
+	}
+
+	var obj cacheObjectInfo
+	call(http.MethodGet, "/object?key=/static", &obj)
+	if len(obj.Variants) != 1 || obj.Variants[0].Hits != 1 || obj.Variants[0].Size != len("static") {
+		t.Errorf("unexpected object: %+v", obj)
+	}
+
+	if code := call(http.MethodDelete, "/object?key=/static", nil); code != http.StatusNoContent {
+		t.Errorf("DELETE /object: got %d, want %d", code, http.StatusNoContent)
+	}
+	if code := call(http.MethodGet, "/object?key=/static", nil); code != http.StatusNotFound {
+		t.Errorf("GET /object after DELETE: got %d, want %d", code, http.StatusNotFound)
+	}
+	if _, cache := get(t, cp, "/static", nil); cache != "MISS" {
+		t.Errorf("/static after DELETE: got %q, want MISS", cache)
+	}
+}
+
+func waitInflight(t *testing.T, cp *CachingProxy, key string) {
+	t.Helper()
+
+	for range 100 {
+		cp.cache.mu.Lock()
+		_, ok := cp.cache.inflight[key]
+		cp.cache.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%q never got in flight", key)
+}
+
+func waitFollowers(t *testing.T, cp *CachingProxy, key string) {
+	t.Helper()
+
+	cp.cache.mu.Lock()
+	f := cp.cache.inflight[key]
+	cp.cache.mu.Unlock()
+	for range 100 {
+		f.mu.Lock()
+		followers := f.followers
+		f.mu.Unlock()
+		if followers > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%q never got followed", key)
+}
+
+type fetchResult struct {
+	body  string
+	cache string
+	err   error
+}
+
+func fetchAsync(url string) chan fetchResult {
+	return fetchAsyncWithContext(context.Background(), url)
+}
+
+func fetchAsyncWithContext(ctx context.Context, url string) chan fetchResult {
+	c := make(chan fetchResult, 1)
+	go func() {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			c <- fetchResult{err: err}
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c <- fetchResult{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		bs, err := io.ReadAll(resp.Body)
+		c <- fetchResult{body: string(bs), cache: resp.Header.Get(cacheStatusHeader), err: err}
+	}()
+	return c
+}
+
+func TestInflightFill(t *testing.T) {
+	o := newTestOrigin(t)
+	cp := newTestCachingProxy(t, o)
+	srv := httptest.NewServer(cp)
+	defer srv.Close()
+
+	leaderC := fetchAsync(srv.URL + "/slow")
+	waitInflight(t, cp, "/slow")
+	followerC := fetchAsync(srv.URL + "/slow")
+	waitFollowers(t, cp, "/slow")
+	close(o.release)
+
+	for name, want := range map[string]struct {
+		c     chan fetchResult
+		cache string
+	}{
+		"leader":   {leaderC, "MISS"},
+		"follower": {followerC, "INFLIGHT"},
+	} {
+		r := <-want.c
+		if r.err != nil || r.body != "0123456789" || r.cache != want.cache {
+			t.Errorf("%s: got %+v, want body %q cache %q", name, r, "0123456789", want.cache)
+		}
+	}
+	if n := o.numReqs.Load(); n != 1 {
+		t.Errorf("origin requests: got %d, want 1", n)
+	}
+	if _, cache := get(t, cp, "/slow", nil); cache != "HIT" {
+		t.Errorf("/slow after fill: got %q, want HIT", cache)
+	}
+}
+
+// blockingWriter is a ResponseWriter whose writes block until release is
+// closed.
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestInflightFillTooLarge(t *testing.T) {
+	o := newTestOrigin(t)
+	cp := newTestCachingProxy(t, o)
+	srv := httptest.NewServer(cp)
+	defer srv.Close()
+
+	leaderC := fetchAsync(srv.URL + "/large")
+	waitInflight(t, cp, "/large")
+	cp.cache.mu.Lock()
+	f := cp.cache.inflight["/large"]
+	cp.cache.mu.Unlock()
+
+	// The follower is stuck until the leader is done, falling behind the
+	// last MaxObjectBytes kept of the body.
+	follower := &blockingWriter{ResponseRecorder: httptest.NewRecorder(), release: make(chan struct{})}
+	followerDone := make(chan struct{})
+	go func() {
+		defer close(followerDone)
+		cp.ServeHTTP(follower, httptest.NewRequest(http.MethodGet, "/large", nil))
+	}()
+	waitFollowers(t, cp, "/large")
+	close(o.release)
+
+	r := <-leaderC
+	if r.err != nil || r.body != largeBody || r.cache != "MISS" {
+		t.Errorf("leader: got %d bytes, cache %q, error %v, want %d bytes, cache MISS",
+			len(r.body), r.cache, r.err, len(largeBody))
+	}
+	f.mu.Lock()
+	kept := len(f.body)
+	f.mu.Unlock()
+	if kept > int(cp.cache.cfg.MaxObjectBytes) {
+		t.Errorf("fill kept %d bytes, want at most MaxObjectBytes=%d", kept, cp.cache.cfg.MaxObjectBytes)
+	}
+
+	close(follower.release)
+	<-followerDone
+	if n := follower.Body.Len(); n >= len(largeBody) {
+		t.Errorf("follower behind the fill: got %d bytes, want it failed", n)
+	}
+	if n := o.numReqs.Load(); n != 1 {
+		t.Errorf("origin requests: got %d, want 1", n)
+	}
+
+	cp.cache.mu.Lock()
+	_, cached := cp.cache.objects["/large"]
+	_, inflight := cp.cache.inflight["/large"]
+	cp.cache.mu.Unlock()
+	if cached || inflight {
+		t.Errorf("too large fill was kept: cached=%v inflight=%v", cached, inflight)
+	}
+}
+
+func TestInflightFillOrphaned(t *testing.T) {
+	o := newTestOrigin(t)
+	cp := newTestCachingProxy(t, o)
+	srv := httptest.NewServer(cp)
+	defer srv.Close()
+	// Lets the origin finish, should it not be canceled, before closing the
+	// proxy.
+	defer close(o.release)
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	defer cancelLeader()
+	followerCtx, cancelFollower := context.WithCancel(context.Background())
+	defer cancelFollower()
+
+	leaderC := fetchAsyncWithContext(leaderCtx, srv.URL+"/stall")
+	waitInflight(t, cp, "/stall")
+	followerC := fetchAsyncWithContext(followerCtx, srv.URL+"/stall")
+	waitFollowers(t, cp, "/stall")
+
+	// The fill goes on for the follower.
+	cancelLeader()
+	<-leaderC
+	time.Sleep(50 * time.Millisecond)
+	if n := o.numCanceled.Load(); n != 0 {
+		t.Fatalf("origin requests canceled with a follower: got %d, want 0", n)
+	}
+
+	// Nobody is left to read the body.
+	cancelFollower()
+	<-followerC
+	for range 100 {
+		if o.numCanceled.Load() > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := o.numCanceled.Load(); n != 1 {
+		t.Errorf("origin requests canceled: got %d, want 1", n)
+	}
+}
+
+func TestClientGone(t *testing.T) {
+	o := newTestOrigin(t)
+	cp := newTestCachingProxy(t, o)
+	srv := httptest.NewServer(cp)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/hang", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errC := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		errC <- err
+	}()
+	for o.numReqs.Load() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-errC
+
+	for range 100 {
+		if o.numCanceled.Load() > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := o.numCanceled.Load(); n != 1 {
+		t.Errorf("origin requests canceled: got %d, want 1", n)
+	}
+	if n := cp.cache.backoff.len(); n != 0 {
+		t.Errorf("URLs backed off: got %d, want 0", n)
+	}
+}
+
+func TestInflightFillAbort(t *testing.T) {
+	o := newTestOrigin(t)
+	cp := newTestCachingProxy(t, o)
+	srv := httptest.NewServer(cp)
+	defer srv.Close()
+
+	errC := make(chan error, 2)
+	fetch := func() {
+		resp, err := http.Get(srv.URL + "/truncated")
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		errC <- err
+	}
+
+	go fetch()
+	waitInflight(t, cp, "/truncated")
+	go fetch()
+	time.Sleep(50 * time.Millisecond)
+	close(o.release)
+
+	for range 2 {
+		if err := <-errC; err == nil {
+			t.Errorf("truncated response was read without error")
+		}
+	}
+
+	cp.cache.mu.Lock()
+	_, cached := cp.cache.objects["/truncated"]
+	_, inflight := cp.cache.inflight["/truncated"]
+	cp.cache.mu.Unlock()
+	if cached || inflight {
+		t.Errorf("partial fill was kept: cached=%v inflight=%v", cached, inflight)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+var errFillTooLarge = errors.New("response is too large to cache")
+var errFillCanceled = errors.New("client went away before the response was complete")
+
+// inflightFill is a response being fetched from the origin into the cache.
+// Requests for the same variant arriving meanwhile are served from the
+// partially received body, instead of going to the origin again.
+type inflightFill struct {
+	key       string
+	variant   string
+	vary      []string
+	reqHeader http.Header
+	status    int
+	header    http.Header
+	ttl       time.Duration
+
+	// Cancels the origin request.
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	body []byte
+	// The offset of body in the response. The start of the body is dropped
+	// once it grows past MaxObjectBytes.
+	base      int
+	done      bool
+	err       error
+	followers int
+
+	// Set once the body grew past MaxObjectBytes. Only the last
+	// MaxObjectBytes of it are kept for the followers so far, and it is not
+	// stored to the cache.
+	uncacheable bool
+
+	// Set once the client went away while others followed the fill. The
+	// origin request is canceled once they are gone too.
+	detached bool
+
+	// Set once the client went away with no followers, and the origin
+	// request is being canceled.
+	closing bool
+}
+
+func newInflightFill(key string, resp *http.Response, ttl time.Duration) *inflightFill {
+	vary := parseVary(resp.Header)
+	f := &inflightFill{
+		key:       key,
+		variant:   variantKey(vary, resp.Request.Header),
+		vary:      vary,
+		reqHeader: resp.Request.Header.Clone(),
+		status:    resp.StatusCode,
+		header:    resp.Header.Clone(),
+		ttl:       ttl,
+	}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// wait blocks until the body grows past off, the fill finishes, or ctx is
+// done. It fails if the body at off was dropped already.
+func (f *inflightFill) wait(ctx context.Context, off int) ([]byte, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for f.base+len(f.body) <= off && !f.done && f.err == nil && ctx.Err() == nil {
+		f.cond.Wait()
+	}
+	if f.err != nil {
+		return nil, false, f.err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	if off < f.base {
+		return nil, false, errFillTooLarge
+	}
+	return f.body[off-f.base:], f.done, nil
+}
+
+// startFill makes f visible to requests for the same variant. If another
+// fill for the key is in flight already, f is fetched on its own.
+func (c *Cache) startFill(f *inflightFill) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.inflight[f.key]; !ok {
+		c.inflight[f.key] = f
+	}
+}
+
+func (c *Cache) endFill(f *inflightFill) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inflight[f.key] == f {
+		delete(c.inflight, f.key)
+	}
+}
+
+// followFill returns the fill in flight for the request, if any. Fills
+// which are being aborted or canceled, or are too large to cache, are not
+// followed.
+func (c *Cache) followFill(key string, h http.Header) *inflightFill {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.inflight[key]
+	if !ok || variantKey(f.vary, h) != f.variant {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil || f.uncacheable || f.closing {
+		return nil
+	}
+	f.followers++
+	return f
+}
+
+// serveFill streams the body of f to the client as it arrives from the origin.
+func (c *Cache) serveFill(w http.ResponseWriter, r *http.Request, f *inflightFill) error {
+	defer func() {
+		f.mu.Lock()
+		f.followers--
+		orphaned := f.detached && f.followers == 0 && !f.done && f.err == nil
+		if orphaned {
+			f.closing = true
+		}
+		f.mu.Unlock()
+		if orphaned {
+			// Nobody is left to read the rest of the body.
+			f.cancel()
+		}
+	}()
+
+	ctx := r.Context()
+	stop := context.AfterFunc(ctx, func() {
+		f.mu.Lock()
+		f.cond.Broadcast()
+		f.mu.Unlock()
+	})
+	defer stop()
+
+	h := w.Header()
+	for k, vs := range f.header {
+		h[k] = slices.Clone(vs)
+	}
+	c.setResult(h, "INFLIGHT")
+	w.WriteHeader(f.status)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	rc := http.NewResponseController(w)
+	off := 0
+	for {
+		chunk, done, err := f.wait(ctx, off)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		_ = rc.Flush()
+		off += len(chunk)
+
+		if done && len(chunk) == 0 {
+			return nil
+		}
+	}
+}
+
+// fillRequest is the origin request of a cache miss. It is canceled when
+// the client goes away, unless the response is streamed to followers of its
+// fill as well.
+type fillRequest struct {
+	key    string
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	fill *inflightFill
+	gone bool
+}
+
+func (fr *fillRequest) setFill(f *inflightFill) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	fr.fill = f
+	f.cancel = fr.cancel
+	f.closing = fr.gone
+}
+
+func (fr *fillRequest) clientGone() {
+	fr.mu.Lock()
+	fr.gone = true
+	f := fr.fill
+	fr.mu.Unlock()
+
+	if f != nil {
+		f.mu.Lock()
+		detached := f.followers > 0
+		f.detached = detached
+		f.closing = !detached
+		f.mu.Unlock()
+		if detached {
+			// The fill completes for the followers, until they are gone. See
+			// fillBody.Close and Cache.serveFill.
+			return
+		}
+	}
+	fr.cancel()
+}
+
+// fillBody copies the response body into the inflightFill as it is streamed
+// to the client, and stores it to the cache once the origin has sent it in
+// full. The fill is discarded if the origin fails mid-body, and not stored if
+// the body turns out larger than MaxObjectBytes.
+type fillBody struct {
+	io.ReadCloser
+
+	cache    *Cache
+	fill     *inflightFill
+	finished bool
+}
+
+func (b *fillBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.finished {
+		return n, err
+	}
+
+	f := b.fill
+	f.mu.Lock()
+	tooLarge := !f.uncacheable && int64(len(f.body)+n) > b.cache.cfg.MaxObjectBytes
+	if tooLarge {
+		f.uncacheable = true
+	}
+	if f.uncacheable && f.followers == 0 {
+		// Nobody else needs the body. Keep streaming it to the client.
+		b.abortLocked(errFillTooLarge)
+		f.mu.Unlock()
+		b.cache.endFill(f)
+		return n, err
+	}
+	f.body = append(f.body, p[:n]...)
+	if drop := len(f.body) - int(b.cache.cfg.MaxObjectBytes); f.uncacheable && drop > 0 {
+		// Followers falling further behind fail, so that the fill holds no
+		// more than MaxObjectBytes.
+		f.body = f.body[drop:]
+		f.base += drop
+	}
+	f.cond.Broadcast()
+	f.mu.Unlock()
+	if tooLarge {
+		// Too large to cache. The followers so far still get the body from
+		// the fill, but new requests go to the origin on their own.
+		b.cache.endFill(f)
+	}
+
+	switch {
+	case err == io.EOF:
+		b.complete()
+	case err != nil:
+		log.Printf("Discarding partial cache fill of %q: %v", f.key, err)
+		b.abort(err)
+	}
+	return n, err
+}
+
+func (b *fillBody) Close() error {
+	if b.finished {
+		return b.ReadCloser.Close()
+	}
+
+	f := b.fill
+	f.mu.Lock()
+	if f.followers == 0 {
+		// Checked under the same lock as in followFill, so that no follower
+		// joins the fill being discarded.
+		b.abortLocked(errFillCanceled)
+		f.mu.Unlock()
+		b.cache.endFill(f)
+		return b.ReadCloser.Close()
+	}
+	f.detached = true
+	f.mu.Unlock()
+
+	// The client went away, but others are waiting for the rest of the body.
+	// The origin request is canceled once they are gone too.
+	go func() {
+		defer b.ReadCloser.Close()
+
+		buf := make([]byte, 32*1024)
+		for !b.finished {
+			if _, err := b.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *fillBody) complete() {
+	b.finished = true
+
+	f := b.fill
+	f.mu.Lock()
+	body, uncacheable := f.body, f.uncacheable
+	f.mu.Unlock()
+
+	if !uncacheable {
+		b.cache.store(f.key, f.reqHeader, f.status, f.header, body, f.ttl)
+	}
+	b.cache.endFill(f)
+
+	f.mu.Lock()
+	f.done = true
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
+
+func (b *fillBody) abort(err error) {
+	f := b.fill
+	f.mu.Lock()
+	b.abortLocked(err)
+	f.mu.Unlock()
+
+	b.cache.endFill(f)
+}
+
+// abortLocked fails the fill for its followers, and keeps new ones from
+// following it. The caller holds f.mu, and ends the fill after releasing it.
+func (b *fillBody) abortLocked(err error) {
+	b.finished = true
+
+	f := b.fill
+	f.err = err
+	f.body = nil
+	f.cond.Broadcast()
+}
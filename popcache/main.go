@@ -16,6 +16,26 @@ import (
 var originURLStr = flag.String("originURL", "http://localhost:8888", "Origin server URL")
 var listenAddr = flag.String("listenAddr", ":8889", "Address to listen on")
 var nodeId = flag.String("nodeId", "unknown_node", "Name of the node")
+var adminListenAddr = flag.String("adminListenAddr", "localhost:8890", "Address to listen on for the admin endpoints")
+var adminToken = flag.String("adminToken", "", "Bearer token required by the admin endpoints. Admin endpoints are disabled if empty.")
+var cacheMaxBytes = flag.Int64("cacheMaxBytes", 256<<20, "Total size of response bodies kept in the cache")
+var cacheMaxObjectBytes = flag.Int64("cacheMaxObjectBytes", 16<<20, "Responses larger than this are not cached")
+var defaultTTL = flag.Duration("defaultTTL", 0, "TTL of cacheable responses with Last-Modified but without explicit freshness information")
+var negativeTTL = flag.Duration("negativeTTL", 30*time.Second, "TTL of 404/410 responses without explicit freshness information")
+var errorTTL = flag.Duration("errorTTL", 5*time.Second, "TTL of 5xx responses. 5xx responses are not cached if zero.")
+var originBackoffMin = flag.Duration("originBackoff", 1*time.Second, "Initial duration a URL failing at the origin is not retried. Disabled if zero.")
+var originBackoffMax = flag.Duration("originMaxBackoff", 1*time.Minute, "Maximum duration a URL failing at the origin is not retried")
+var originMaxIdleConns = flag.Int("originMaxIdleConns", 100, "Maximum number of idle connections to the origin")
+var originMaxIdleConnsPerHost = flag.Int("originMaxIdleConnsPerHost", 32, "Maximum number of idle connections per origin host")
+var originMaxConnsPerHost = flag.Int("originMaxConnsPerHost", 0, "Maximum number of connections per origin host. Unlimited if zero.")
+var originIdleConnTimeout = flag.Duration("originIdleConnTimeout", 90*time.Second, "How long an idle origin connection is kept alive")
+var originKeepAlive = flag.Duration("originKeepAlive", 30*time.Second, "TCP keep-alive period of origin connections")
+var originDialTimeout = flag.Duration("originDialTimeout", 5*time.Second, "Timeout to establish a TCP connection to the origin")
+var originTLSHandshakeTimeout = flag.Duration("originTLSHandshakeTimeout", 5*time.Second, "Timeout of the TLS handshake with the origin")
+var originResponseHeaderTimeout = flag.Duration("originResponseHeaderTimeout", 30*time.Second, "Timeout to receive the response headers from the origin")
+var originHTTP2 = flag.Bool("originHTTP2", true, "Attempt HTTP/2 to https:// origins")
+var originH2C = flag.Bool("originH2C", false, "Use HTTP/2 with prior knowledge to http:// origins")
+var originDNSRefresh = flag.Duration("originDNSRefresh", 30*time.Second, "Interval to re-resolve the origin host. Resolved on every dial if zero.")
 
 func main() {
 	flag.Parse()
@@ -53,14 +73,49 @@ func main() {
 		// return 204
 		w.WriteHeader(http.StatusNoContent)
 	})
-	mux.Handle("/", &httputil.ReverseProxy{
-		// FIXME: actually cache stuff...
+	cache := NewCache(CacheConfig{
+		MaxBytes:         *cacheMaxBytes,
+		MaxObjectBytes:   *cacheMaxObjectBytes,
+		DefaultTTL:       *defaultTTL,
+		NegativeTTL:      *negativeTTL,
+		ErrorTTL:         *errorTTL,
+		OriginBackoff:    *originBackoffMin,
+		OriginMaxBackoff: *originBackoffMax,
+	})
+	ot := newOriginTransport(OriginTransportConfig{
+		MaxIdleConns:          *originMaxIdleConns,
+		MaxIdleConnsPerHost:   *originMaxIdleConnsPerHost,
+		MaxConnsPerHost:       *originMaxConnsPerHost,
+		IdleConnTimeout:       *originIdleConnTimeout,
+		KeepAlive:             *originKeepAlive,
+		DialTimeout:           *originDialTimeout,
+		TLSHandshakeTimeout:   *originTLSHandshakeTimeout,
+		ResponseHeaderTimeout: *originResponseHeaderTimeout,
+		HTTP2:                 *originHTTP2,
+		H2C:                   *originH2C,
+		DNSRefresh:            *originDNSRefresh,
+	})
+	cp := NewCachingProxy(cache, &httputil.ReverseProxy{
+		Transport: ot,
 		Rewrite: func(r *httputil.ProxyRequest) {
 			r.SetXForwarded()
 			r.Out.Header.Set("X-NCDN-PoPCache-NodeId", *nodeId)
 			r.SetURL(originURL)
 		},
 	})
+	mux.Handle("/", cp)
+
+	if *adminToken != "" {
+		go func() {
+			log.Printf("Listening on %s for admin endpoints...", *adminListenAddr)
+			admin := newAdminHandler(cp, ot, serveWarm(cp, originURL))
+			if err := http.ListenAndServe(*adminListenAddr, admin); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	} else {
+		log.Printf("Admin endpoints are disabled since -adminToken is not set.")
+	}
 
 	log.Printf("Listening on %s...", *listenAddr)
 	if err := http.ListenAndServe(*listenAddr, nil); err != nil {
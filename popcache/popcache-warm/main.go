@@ -0,0 +1,118 @@
+// popcache-warm pre-populates the cache of a popcache node, so that the first
+// users routed to a freshly started PoP don't pay for a cold cache.
+//
+// URLs are read one per line from `-urls` (blank lines and lines starting
+// with '#' are ignored), and/or taken from a sitemap on the origin.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/yzp0n/ncdn/types"
+)
+
+var adminURL = flag.String("adminURL", "http://localhost:8890", "URL of the admin endpoints of the popcache node to warm")
+var adminToken = flag.String("adminToken", "", "Bearer token for the popcache admin endpoints")
+var urlsFile = flag.String("urls", "", "File listing URLs to warm, one per line. \"-\" reads from stdin.")
+var sitemapPath = flag.String("sitemap", "", "Path of a sitemap on the origin listing URLs to warm, e.g. /sitemap.xml")
+var concurrency = flag.Int("concurrency", 4, "Number of URLs fetched in parallel by the popcache node")
+
+func readURLs(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var urls []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		urls = append(urls, l)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", path, err)
+	}
+	return urls, nil
+}
+
+func main() {
+	flag.Parse()
+
+	args := types.WarmArgs{
+		Sitemap:     *sitemapPath,
+		Concurrency: *concurrency,
+	}
+	if *urlsFile != "" {
+		urls, err := readURLs(*urlsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		args.URLs = urls
+	}
+	if len(args.URLs) == 0 && args.Sitemap == "" {
+		log.Fatal("Nothing to warm. Specify -urls and/or -sitemap.")
+	}
+
+	argsBs, err := json.Marshal(&args)
+	if err != nil {
+		log.Fatalf("Failed to marshal WarmArgs: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*adminURL, "/")+"/warmz", bytes.NewBuffer(argsBs))
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+*adminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bs, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Warm request failed: %s: %s", resp.Status, strings.TrimSpace(string(bs)))
+	}
+
+	failed := 0
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var p types.WarmProgress
+		if err := dec.Decode(&p); err != nil {
+			if err == io.EOF {
+				break
+			}
+			log.Fatalf("Failed to read progress: %v", err)
+		}
+
+		if p.Error != "" {
+			failed++
+			log.Printf("[%d/%d] %s: %s", p.Done, p.Total, p.Url, p.Error)
+			continue
+		}
+		log.Printf("[%d/%d] %s: %d %s", p.Done, p.Total, p.Url, p.Status, p.Cache)
+	}
+
+	if failed > 0 {
+		log.Fatalf("%d URLs failed to warm", failed)
+	}
+}
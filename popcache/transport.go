@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type OriginTransportConfig struct {
+	// Limits of the connection pool. See http.Transport for the semantics.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+
+	// TCP keep-alive period of origin connections.
+	KeepAlive time.Duration
+
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// Attempt HTTP/2 on https:// origins.
+	HTTP2 bool
+
+	// Speak HTTP/2 with prior knowledge on http:// origins.
+	H2C bool
+
+	// The origin host name is resolved again after DNSRefresh, and idle
+	// connections are dropped if its addresses changed. If zero, the system
+	// resolver is used on every dial.
+	DNSRefresh time.Duration
+}
+
+type resolvedHost struct {
+	addrs   []string
+	expires time.Time
+	next    int
+}
+
+type originConnStats struct {
+	dials      atomic.Int64
+	dialErrors atomic.Int64
+	open       atomic.Int64
+	requests   atomic.Int64
+	reused     atomic.Int64
+}
+
+type originStatsJSON struct {
+	Origin     string   `json:"origin"`
+	Addrs      []string `json:"addrs,omitempty"`
+	Dials      int64    `json:"dials"`
+	DialErrors int64    `json:"dial_errors"`
+	Open       int64    `json:"open"`
+	Requests   int64    `json:"requests"`
+	Reused     int64    `json:"reused"`
+}
+
+// originTransport is the http.RoundTripper used to reach the origin. It keeps
+// per-origin connection stats, and pins resolved origin addresses for
+// OriginTransportConfig.DNSRefresh.
+type originTransport struct {
+	*http.Transport
+
+	cfg    OriginTransportConfig
+	dialer *net.Dialer
+
+	mu       sync.Mutex
+	resolved map[string]*resolvedHost
+	stats    map[string]*originConnStats
+}
+
+func newOriginTransport(cfg OriginTransportConfig) *originTransport {
+	t := &originTransport{
+		cfg: cfg,
+		dialer: &net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: cfg.KeepAlive,
+		},
+
+		resolved: make(map[string]*resolvedHost),
+		stats:    make(map[string]*originConnStats),
+	}
+
+	var protocols http.Protocols
+	protocols.SetHTTP1(!cfg.H2C)
+	protocols.SetHTTP2(cfg.HTTP2 || cfg.H2C)
+	protocols.SetUnencryptedHTTP2(cfg.H2C)
+
+	t.Transport = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           t.dialContext,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		Protocols:             &protocols,
+	}
+	return t
+}
+
+// originAddr returns the "host:port" the transport dials for u.
+func originAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func (t *originTransport) statsFor(addr string) *originConnStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.stats[addr]
+	if !ok {
+		s = &originConnStats{}
+		t.stats[addr] = s
+	}
+	return s
+}
+
+func (t *originTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := t.statsFor(originAddr(req.URL))
+	s.requests.Add(1)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				s.reused.Add(1)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return t.Transport.RoundTrip(req)
+}
+
+// lookup returns the addresses to dial for host, in the order to try them.
+func (t *originTransport) lookup(ctx context.Context, host string) ([]string, error) {
+	now := time.Now()
+
+	t.mu.Lock()
+	rh, ok := t.resolved[host]
+	if ok && now.Before(rh.expires) {
+		rh.next++
+		addrs := rotate(rh.addrs, rh.next)
+		t.mu.Unlock()
+		return addrs, nil
+	}
+	t.mu.Unlock()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		if ok {
+			log.Printf("Failed to re-resolve origin %q, using the previous addresses: %v", host, err)
+			return rh.addrs, nil
+		}
+		return nil, err
+	}
+	slices.Sort(addrs)
+
+	t.mu.Lock()
+	changed := ok && !slices.Equal(rh.addrs, addrs)
+	t.resolved[host] = &resolvedHost{
+		addrs:   addrs,
+		expires: now.Add(t.cfg.DNSRefresh),
+	}
+	t.mu.Unlock()
+
+	if changed {
+		log.Printf("Origin %q moved from %v to %v. Dropping idle connections.", host, rh.addrs, addrs)
+		t.CloseIdleConnections()
+	}
+	return addrs, nil
+}
+
+func rotate(addrs []string, n int) []string {
+	n %= len(addrs)
+	return append(slices.Clone(addrs[n:]), addrs[:n]...)
+}
+
+func (t *originTransport) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	s := t.statsFor(addr)
+	s.dials.Add(1)
+
+	conn, err := t.dial(ctx, network, addr)
+	if err != nil {
+		s.dialErrors.Add(1)
+		return nil, err
+	}
+
+	s.open.Add(1)
+	return &countedConn{Conn: conn, stats: s}, nil
+}
+
+func (t *originTransport) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.cfg.DNSRefresh <= 0 || net.ParseIP(host) != nil {
+		return t.dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := t.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, a := range addrs {
+		conn, err := t.dialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (t *originTransport) statsJSON() []originStatsJSON {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ret []originStatsJSON
+	for addr, s := range t.stats {
+		o := originStatsJSON{
+			Origin:     addr,
+			Dials:      s.dials.Load(),
+			DialErrors: s.dialErrors.Load(),
+			Open:       s.open.Load(),
+			Requests:   s.requests.Load(),
+			Reused:     s.reused.Load(),
+		}
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			if rh, ok := t.resolved[host]; ok {
+				o.Addrs = slices.Clone(rh.addrs)
+			}
+		}
+		ret = append(ret, o)
+	}
+	slices.SortFunc(ret, func(a, b originStatsJSON) int {
+		return strings.Compare(a.Origin, b.Origin)
+	})
+	return ret
+}
+
+// countedConn keeps originConnStats.open up to date.
+type countedConn struct {
+	net.Conn
+
+	stats  *originConnStats
+	closed sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closed.Do(func() {
+		c.stats.open.Add(-1)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOriginTransport(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	// Dial by name, so that the origin address goes through lookup().
+	u, _ := url.Parse(origin.URL)
+	originURL := "http://" + strings.Replace(u.Host, "127.0.0.1", "localhost", 1)
+
+	ot := newOriginTransport(OriginTransportConfig{
+		MaxIdleConns:        10,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     time.Minute,
+		DialTimeout:         time.Second,
+		DNSRefresh:          time.Minute,
+	})
+	defer ot.CloseIdleConnections()
+	client := &http.Client{Transport: ot}
+
+	for range 3 {
+		resp, err := client.Get(originURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	stats := ot.statsJSON()
+	if len(stats) != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	s := stats[0]
+	t.Logf("stats: %+v", s)
+	if s.Requests != 3 || s.Dials != 1 || s.Reused != 2 || s.Open != 1 || len(s.Addrs) == 0 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
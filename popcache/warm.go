@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/yzp0n/ncdn/types"
+)
+
+const maxWarmConcurrency = 64
+
+// Subset of https://www.sitemaps.org/protocol.html. A sitemap index is
+// followed for one level.
+type sitemap struct {
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// sitemapClient fetches sitemaps over the transport of the proxy, without
+// following redirects off the origin.
+func sitemapClient(cp *CachingProxy, originURL *url.URL) *http.Client {
+	transport := cp.proxy.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host != originURL.Host {
+				return fmt.Errorf("Sitemap redirected off the origin to %s", req.URL)
+			}
+			if len(via) >= 10 {
+				return errors.New("Sitemap redirected too many times")
+			}
+			return nil
+		},
+	}
+}
+
+// fetchSitemap fetches the sitemap at ref relative to the origin. Sitemaps
+// on other hosts are rejected.
+func fetchSitemap(ctx context.Context, client *http.Client, originURL *url.URL, ref string) (*sitemap, error) {
+	parsed, err := url.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse sitemap URL %q: %v", ref, err)
+	}
+	u := originURL.ResolveReference(parsed)
+	if u.Host != originURL.Host {
+		return nil, fmt.Errorf("Sitemap %s is not on the origin %s", u, originURL.Host)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status fetching sitemap %s: %s", u, resp.Status)
+	}
+
+	var sm sitemap
+	if err := xml.NewDecoder(resp.Body).Decode(&sm); err != nil {
+		return nil, fmt.Errorf("Failed to parse sitemap %s: %v", u, err)
+	}
+	return &sm, nil
+}
+
+func sitemapURLs(ctx context.Context, client *http.Client, originURL *url.URL, path string) ([]string, error) {
+	sm, err := fetchSitemap(ctx, client, originURL, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, l := range sm.URLs {
+		urls = append(urls, l.Loc)
+	}
+	for _, l := range sm.Sitemaps {
+		child, err := fetchSitemap(ctx, client, originURL, l.Loc)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range child.URLs {
+			urls = append(urls, l.Loc)
+		}
+	}
+	return urls, nil
+}
+
+// warmResponseWriter discards the response body, so that the CachingProxy
+// fills the cache without anyone to serve to.
+type warmResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *warmResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *warmResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *warmResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
+
+func warmOne(ctx context.Context, cp *CachingProxy, rawURL string) types.WarmProgress {
+	p := types.WarmProgress{Url: rawURL}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	// The cache is keyed by the request URI, regardless of the host in the sitemap.
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.RequestURI(), nil)
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+
+	w := &warmResponseWriter{header: make(http.Header)}
+	cp.ServeHTTP(w, req)
+
+	p.Status = w.status
+	p.Cache = w.header.Get(cacheStatusHeader)
+	if p.Status >= 400 {
+		p.Error = http.StatusText(p.Status)
+	}
+	return p
+}
+
+func serveWarm(cp *CachingProxy, originURL *url.URL) http.HandlerFunc {
+	client := sitemapClient(cp, originURL)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+			return
+		}
+		var args types.WarmArgs
+		if err := json.Unmarshal(body, &args); err != nil {
+			http.Error(w, "Failed to parse JSON data", http.StatusBadRequest)
+			return
+		}
+
+		// Requests made on behalf of the cache must not carry the server
+		// context of r, or ReverseProxy would panic on an origin failure
+		// outside of the handler goroutine. Still stop warming once the
+		// client goes away.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stop := context.AfterFunc(r.Context(), cancel)
+		defer stop()
+
+		urls := args.URLs
+		if args.Sitemap != "" {
+			smURLs, err := sitemapURLs(ctx, client, originURL, args.Sitemap)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			urls = append(urls, smURLs...)
+		}
+
+		concurrency := min(max(args.Concurrency, 1), maxWarmConcurrency)
+		log.Printf("Warming %d URLs with concurrency %d", len(urls), concurrency)
+
+		urlC := make(chan string)
+		resultC := make(chan types.WarmProgress)
+		var wg sync.WaitGroup
+		for range concurrency {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for u := range urlC {
+					resultC <- warmOne(ctx, cp, u)
+				}
+			}()
+		}
+		go func() {
+			defer close(urlC)
+			for _, u := range urls {
+				select {
+				case urlC <- u:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		go func() {
+			wg.Wait()
+			close(resultC)
+		}()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		enc := json.NewEncoder(w)
+
+		done := 0
+		for p := range resultC {
+			done++
+			p.Done = done
+			p.Total = len(urls)
+			if err := enc.Encode(&p); err != nil {
+				// Keep draining resultC until the workers notice the cancel.
+				cancel()
+				continue
+			}
+			_ = rc.Flush()
+		}
+		log.Printf("Warming done: %d/%d URLs", done, len(urls))
+	}
+}
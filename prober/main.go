@@ -61,6 +61,7 @@ func probe(targetURL string) (*types.ProbeResult, error) {
 	}
 	resp.Body.Close()
 
+	r.ResponseEnd = time.Now().UnixNano()
 	r.ResponseCode = resp.StatusCode
 
 	return r, nil
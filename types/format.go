@@ -8,13 +8,19 @@ import (
 func (p *PoPInfo) FormatWebUIJson() []byte {
 	in := struct {
 		Id         string `json:"id"`
-		Ip4        string `json:"ip4"`
+		Ip4        string `json:"ip4,omitempty"`
+		Ip6        string `json:"ip6,omitempty"`
 		UIPopupCSS string `json:"ui_popup_css"`
 	}{
 		Id:         p.Id,
-		Ip4:        p.Ip4.String(),
 		UIPopupCSS: p.UIPopupCSS,
 	}
+	if p.Ip4.IsValid() {
+		in.Ip4 = p.Ip4.String()
+	}
+	if p.Ip6.IsValid() {
+		in.Ip6 = p.Ip6.String()
+	}
 	bs, err := json.Marshal(&in)
 	if err != nil {
 		slog.Error("Failed to marshal PoPInfo", slog.String("error", err.Error()))
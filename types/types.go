@@ -6,12 +6,18 @@ type PoPInfo struct {
 	// The PoP identifier for convenience
 	Id string
 
-	// The IPv4 address of the PoP
+	// The IPv4 address of the PoP, if any
 	Ip4 netip.Addr
 
+	// The IPv6 address of the PoP, if any
+	Ip6 netip.Addr
+
 	// The URL fetched by probers to measure latency
 	LatencyEndpointUrl string
 
+	// The requests per second the PoP can serve. Unlimited if zero.
+	Capacity float64
+
 	// [webui] CSS of the region popup
 	UIPopupCSS string
 }
@@ -20,16 +26,36 @@ type RegionInfo struct {
 	// The region identifier for convenience
 	Id string
 
-	// IPv4 Prefixes constituting the user region
+	// IPv4 and IPv6 prefixes constituting the user region
 	Prefixes []netip.Prefix
 
+	// Files listing more prefixes of the region, reloaded periodically
+	PrefixSources []PrefixSource
+
 	// The prober that we will use to represent the region
 	ProberURL string
 
+	// The phase of the probes taken as the latency, e.g. "connect". See
+	// gslbcore.ParseProbePhase.
+	LatencyPhase string
+
 	// [webui] CSS of the region popup
 	UIPopupCSS string
 }
 
+type PrefixSource struct {
+	// "csv", "mmdb" or "bgpdump"
+	Format string
+
+	Path string
+
+	// [mmdb] Take the networks of the ISO 3166-1 country code
+	Country string
+
+	// [mmdb, bgpdump] Take the networks originated by any of the ASNs
+	ASNs []uint32
+}
+
 type PoPStatus struct {
 	Id     string  `json:"id"`
 	Uptime float64 `json:"uptime"`
@@ -52,3 +78,39 @@ type ProbeResult struct {
 	ResponseEnd  int64  `json:"response_end"`
 	ResponseCode int    `json:"response_code"`
 }
+
+// RUMBeacon is the navigation timing of a page served by a PoP, as reported
+// by the browser of a real user. The timestamps are those of the
+// PerformanceTiming API, in Unix milliseconds. The client is the sender of
+// the beacon.
+type RUMBeacon struct {
+	PopId string `json:"pop_id"`
+
+	FetchStart      int64 `json:"fetch_start"`
+	DomainLookupEnd int64 `json:"domain_lookup_end"`
+	ConnectStart    int64 `json:"connect_start"`
+	ConnectEnd      int64 `json:"connect_end"`
+	RequestStart    int64 `json:"request_start"`
+	ResponseStart   int64 `json:"response_start"`
+	ResponseEnd     int64 `json:"response_end"`
+}
+
+type WarmArgs struct {
+	// Request URIs or absolute URLs to be fetched into the cache.
+	URLs []string `json:"urls,omitempty"`
+
+	// Path of a sitemap on the origin listing additional URLs to be fetched.
+	Sitemap string `json:"sitemap,omitempty"`
+
+	// Number of URLs fetched in parallel.
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+type WarmProgress struct {
+	Url    string `json:"url"`
+	Status int    `json:"status,omitempty"`
+	Cache  string `json:"cache,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Done   int    `json:"done"`
+	Total  int    `json:"total"`
+}